@@ -0,0 +1,511 @@
+// Command loadtest sweeps a matrix of code host misbehaviour and request
+// settings against the repositories proxy and reports how it copes.
+//
+// By default the proxy is run in-process so that the code host query
+// parameters (failRatio and latency) can be attached to every upstream
+// call and so that upstream calls and goroutines can be measured. The
+// code host is targeted at -repository-addr, started from -repository-bin
+// or, when neither is set, run in-process.
+//
+// A running cmd/repositories is targeted instead with -proxy-addr. The
+// query parameters are then passed through as upstream.* parameters, so
+// the proxy must trust -upstream-token, upstream calls are counted
+// through the /admin/stats endpoint of -repository-addr when it is set,
+// and goroutines are not measured.
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/georgemac/repositories/pkg/client"
+	"github.com/georgemac/repositories/pkg/codehost"
+	"github.com/georgemac/repositories/pkg/models"
+	"github.com/georgemac/repositories/pkg/repositories"
+	"github.com/georgemac/repositories/pkg/server"
+	"github.com/georgemac/repositories/pkg/stats"
+)
+
+var (
+	repositoryAddr = flag.String("repository-addr", "", "address on which repository service is found")
+	repositoryBin  = flag.String("repository-bin", "", "path to a cmd/repository binary to start on -repository-addr (default http://localhost:7080)")
+	proxyAddr      = flag.String("proxy-addr", "", "address of a running repositories proxy to target instead of an in-process one")
+	upstreamToken  = flag.String("upstream-token", "", "token the proxy at -proxy-addr trusts to pass upstream parameters through")
+	failRatios     = flag.String("fail-ratios", "0,0.3,0.7", "comma separated code host failRatio values")
+	latencies      = flag.String("latencies", "0s,100ms,500ms", "comma separated code host latency values")
+	counts         = flag.String("counts", "1,5,10", "comma separated count values")
+	uniques        = flag.String("unique", "false,true", "comma separated unique values")
+	requests       = flag.Int("requests", 50, "requests made for each combination")
+	concurrency    = flag.Int("concurrency", 10, "requests in flight at once for each combination")
+	timeout        = flag.Duration("timeout", 10*time.Second, "client timeout for each request")
+	format         = flag.String("format", "table", "report format: table, csv or json")
+	output         = flag.String("output", "", "file to write the report to (default stdout)")
+)
+
+type scenario struct {
+	FailRatio float64       `json:"failRatio"`
+	Latency   time.Duration `json:"latency"`
+	Count     int           `json:"count"`
+	Unique    bool          `json:"unique"`
+}
+
+type result struct {
+	scenario
+	Requests int     `json:"requests"`
+	Success  float64 `json:"successRate"`
+	P50      string  `json:"p50"`
+	P95      string  `json:"p95"`
+	P99      string  `json:"p99"`
+	// UpstreamPerRepository is the number of code host calls
+	// made for every repository returned to a client.
+	UpstreamPerRepository float64 `json:"upstreamCallsPerRepository"`
+	PeakGoroutines        int     `json:"peakGoroutines"`
+	// SettledGoroutines is measured once all requests have
+	// completed and helps spot leaked workers.
+	SettledGoroutines int `json:"settledGoroutines"`
+}
+
+func main() {
+	flag.Parse()
+
+	scenarios, err := matrix()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	write, ok := writers[*format]
+	if !ok {
+		log.Fatalf("unsupported format %q", *format)
+	}
+
+	switch {
+	case *repositoryBin != "":
+		if *repositoryAddr == "" {
+			*repositoryAddr = "http://localhost:7080"
+		}
+
+		stop, err := startRepository(*repositoryBin, *repositoryAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		defer stop()
+	case *repositoryAddr == "" && *proxyAddr == "":
+		host := httptest.NewServer(codehost.New())
+		defer host.Close()
+
+		*repositoryAddr = host.URL
+	}
+
+	var results []result
+	for _, s := range scenarios {
+		log.Printf("running failRatio=%v latency=%s count=%d unique=%t", s.FailRatio, s.Latency, s.Count, s.Unique)
+
+		r, err := run(s)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		results = append(results, r)
+	}
+
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		fi, err := os.Create(*output)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		defer fi.Close()
+
+		w = fi
+	}
+
+	if err := write(w, results); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func matrix() (scenarios []scenario, err error) {
+	var (
+		fails  []float64
+		lats   []time.Duration
+		cnts   []int
+		uniqs  []bool
+		splitF = func(v string, fn func(string) error) error {
+			for _, f := range strings.Split(v, ",") {
+				if err := fn(strings.TrimSpace(f)); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}
+	)
+
+	if err := splitF(*failRatios, func(v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+		fails = append(fails, f)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := splitF(*latencies, func(v string) error {
+		d, err := time.ParseDuration(v)
+		lats = append(lats, d)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := splitF(*counts, func(v string) error {
+		c, err := strconv.Atoi(v)
+		cnts = append(cnts, c)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := splitF(*uniques, func(v string) error {
+		u, err := strconv.ParseBool(v)
+		uniqs = append(uniqs, u)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, f := range fails {
+		for _, l := range lats {
+			for _, c := range cnts {
+				for _, u := range uniqs {
+					scenarios = append(scenarios, scenario{FailRatio: f, Latency: l, Count: c, Unique: u})
+				}
+			}
+		}
+	}
+
+	return scenarios, nil
+}
+
+// startRepository starts the code host binary listening on the port of
+// addr and waits for it to accept connections.
+func startRepository(bin, addr string) (func(), error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(bin)
+	cmd.Env = append(os.Environ(), "PORT="+u.Port())
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	stop := func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", u.Host); err == nil {
+			conn.Close()
+			return stop, nil
+		}
+	}
+
+	stop()
+
+	return nil, errors.New("timed out waiting for repository service to start")
+}
+
+// upstream attaches the code host misbehaviour parameters to,
+// and counts, every call made by the proxy.
+type upstream struct {
+	query url.Values
+	calls int64
+}
+
+func (u *upstream) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&u.calls, 1)
+
+	r = r.Clone(r.Context())
+
+	query := r.URL.Query()
+	for k, v := range u.query {
+		query[k] = v
+	}
+
+	r.URL.RawQuery = query.Encode()
+
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func run(s scenario) (result, error) {
+	var (
+		query = url.Values{
+			"failRatio": {strconv.FormatFloat(s.FailRatio, 'f', -1, 64)},
+			"latency":   {s.Latency.String()},
+		}
+		opts     = []models.Option{models.WithCount(s.Count)}
+		external = *proxyAddr != ""
+		proxy    = *proxyAddr
+		calls    = hostCalls
+		cliOpts  = []client.Option{client.WithHTTPClient(&http.Client{Timeout: *timeout})}
+		settle   = func() {}
+	)
+
+	if s.Unique {
+		opts = append(opts, models.Unique)
+	}
+
+	if external {
+		opts = append(opts, models.WithUpstreamParams(query))
+
+		if *upstreamToken != "" {
+			cliOpts = []client.Option{client.WithHTTPClient(&http.Client{
+				Timeout:   *timeout,
+				Transport: upstreamTokenTransport(*upstreamToken),
+			})}
+		}
+	} else {
+		up := &upstream{query: query}
+
+		service, err := repositories.New(*repositoryAddr, repositories.WithClient(&http.Client{Transport: up}))
+		if err != nil {
+			return result{}, err
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/repositories", server.New(service))
+
+		srv := httptest.NewServer(mux)
+		defer srv.Close()
+
+		proxy = srv.URL
+		calls = func() (int64, error) { return atomic.LoadInt64(&up.calls), nil }
+
+		// give abandoned upstream calls a chance to wind down
+		settle = func() {
+			srv.CloseClientConnections()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	cli, err := client.New(proxy, cliOpts...)
+	if err != nil {
+		return result{}, err
+	}
+
+	callsBefore, err := calls()
+	if err != nil {
+		return result{}, err
+	}
+
+	var (
+		work       = make(chan struct{}, *requests)
+		mu         sync.Mutex
+		latencies  []time.Duration
+		returned   int
+		wg         sync.WaitGroup
+		done       = make(chan struct{})
+		peak       = runtime.NumGoroutine()
+		peakDone   = make(chan struct{})
+		sampleTick = time.NewTicker(10 * time.Millisecond)
+	)
+
+	defer sampleTick.Stop()
+
+	go func() {
+		defer close(peakDone)
+
+		for {
+			select {
+			case <-sampleTick.C:
+				if n := runtime.NumGoroutine(); n > peak {
+					peak = n
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < *requests; i++ {
+		work <- struct{}{}
+	}
+
+	close(work)
+
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for range work {
+				start := time.Now()
+				repos, err := cli.Get(context.Background(), opts...)
+				took := time.Since(start)
+
+				if err != nil {
+					continue
+				}
+
+				mu.Lock()
+				latencies = append(latencies, took)
+				returned += len(repos)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	<-peakDone
+
+	settle()
+
+	callsAfter, err := calls()
+	if err != nil {
+		return result{}, err
+	}
+
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+
+	r := result{
+		scenario: s,
+		Requests: *requests,
+		Success:  float64(len(latencies)) / float64(*requests),
+		P50:      stats.Percentile(latencies, 50).String(),
+		P95:      stats.Percentile(latencies, 95).String(),
+		P99:      stats.Percentile(latencies, 99).String(),
+	}
+
+	if !external {
+		r.PeakGoroutines, r.SettledGoroutines = peak, runtime.NumGoroutine()
+	}
+
+	if returned > 0 {
+		r.UpstreamPerRepository = float64(callsAfter-callsBefore) / float64(returned)
+	}
+
+	return r, nil
+}
+
+// hostCalls returns the number of calls served by the code host at
+// -repository-addr, or 0 when it is not set.
+func hostCalls() (int64, error) {
+	if *repositoryAddr == "" {
+		return 0, nil
+	}
+
+	target, err := url.Parse(*repositoryAddr)
+	if err != nil {
+		return 0, err
+	}
+
+	target.Path, target.RawQuery = "/admin/stats", ""
+
+	resp, err := http.Get(target.String())
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("code host stats responded with status %d", resp.StatusCode)
+	}
+
+	var hostStats codehost.Stats
+	if err := json.NewDecoder(resp.Body).Decode(&hostStats); err != nil {
+		return 0, err
+	}
+
+	return int64(hostStats.Calls), nil
+}
+
+// upstreamTokenTransport presents the token trusted by
+// the proxy to pass upstream parameters through.
+type upstreamTokenTransport string
+
+func (t upstreamTokenTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("X-Upstream-Token", string(t))
+
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+var header = []string{"failRatio", "latency", "count", "unique", "requests", "success", "p50", "p95", "p99", "upstream/repo", "peak goroutines", "settled goroutines"}
+
+func (r result) row() []string {
+	return []string{
+		strconv.FormatFloat(r.FailRatio, 'f', -1, 64),
+		r.Latency.String(),
+		strconv.Itoa(r.Count),
+		strconv.FormatBool(r.Unique),
+		strconv.Itoa(r.Requests),
+		fmt.Sprintf("%.1f%%", r.Success*100),
+		r.P50,
+		r.P95,
+		r.P99,
+		fmt.Sprintf("%.2f", r.UpstreamPerRepository),
+		strconv.Itoa(r.PeakGoroutines),
+		strconv.Itoa(r.SettledGoroutines),
+	}
+}
+
+var writers = map[string]func(io.Writer, []result) error{
+	"table": func(w io.Writer, results []result) error {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+		fmt.Fprintln(tw, strings.ToUpper(strings.Join(header, "\t")))
+		for _, r := range results {
+			fmt.Fprintln(tw, strings.Join(r.row(), "\t"))
+		}
+
+		return tw.Flush()
+	},
+	"csv": func(w io.Writer, results []result) error {
+		cw := csv.NewWriter(w)
+
+		cw.Write(header)
+		for _, r := range results {
+			cw.Write(r.row())
+		}
+
+		cw.Flush()
+
+		return cw.Error()
+	},
+	"json": func(w io.Writer, results []result) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(results)
+	},
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/georgemac/repositories/pkg/stats"
+)
+
+func bench(args []string) error {
+	var (
+		set         = flag.NewFlagSet("bench", flag.ExitOnError)
+		flags       = newRequestFlags(set)
+		requests    = set.Int("requests", 100, "total number of requests to make")
+		concurrency = set.Int("concurrency", 10, "number of requests in flight at once")
+	)
+
+	set.Parse(args)
+
+	if *requests < 1 || *concurrency < 1 {
+		return fmt.Errorf("requests and concurrency must be positive")
+	}
+
+	cli, err := flags.client()
+	if err != nil {
+		return err
+	}
+
+	req, err := flags.request()
+	if err != nil {
+		return err
+	}
+
+	var (
+		work      = make(chan struct{}, *requests)
+		mu        sync.Mutex
+		latencies []time.Duration
+		failures  int
+		wg        sync.WaitGroup
+		start     = time.Now()
+	)
+
+	for i := 0; i < *requests; i++ {
+		work <- struct{}{}
+	}
+
+	close(work)
+
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for range work {
+				began := time.Now()
+				_, err := cli.Repositories(context.Background(), req)
+				took := time.Since(began)
+
+				mu.Lock()
+				if err != nil {
+					failures++
+				} else {
+					latencies = append(latencies, took)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	elapsed := time.Since(start)
+
+	fmt.Printf("%-10s %d (%d failed)\n", "requests:", *requests, failures)
+	fmt.Printf("%-10s %s (%.2f req/s)\n", "elapsed:", elapsed, float64(*requests)/elapsed.Seconds())
+
+	if len(latencies) == 0 {
+		return nil
+	}
+
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+
+	fmt.Printf("%-10s %s\n", "min:", latencies[0])
+	for _, p := range []float64{50, 90, 95, 99} {
+		fmt.Printf("%-10s %s\n", fmt.Sprintf("p%.0f:", p), stats.Percentile(latencies, p))
+	}
+	fmt.Printf("%-10s %s\n", "max:", latencies[len(latencies)-1])
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/georgemac/repositories/pkg/models"
+)
+
+const (
+	highlight = "\x1b[1;33m"
+	reset     = "\x1b[0m"
+)
+
+func get(args []string) error {
+	var (
+		set    = flag.NewFlagSet("get", flag.ExitOnError)
+		flags  = newRequestFlags(set)
+		output = set.String("output", "table", "output format: table, json or csv")
+		watch  = set.Duration("watch", 0, "re-poll at this interval, highlighting changed fetchedAt values")
+	)
+
+	set.Parse(args)
+
+	write, ok := writers[*output]
+	if !ok {
+		return fmt.Errorf("unsupported output %q", *output)
+	}
+
+	cli, err := flags.client()
+	if err != nil {
+		return err
+	}
+
+	req, err := flags.request()
+	if err != nil {
+		return err
+	}
+
+	var previous map[int]time.Time
+
+	for {
+		repos, err := cli.Repositories(context.Background(), req)
+		if err != nil {
+			return err
+		}
+
+		changed := map[int]bool{}
+		if previous != nil {
+			for i, repo := range repos {
+				if fetchedAt, ok := previous[repo.ID]; ok && !fetchedAt.Equal(repo.FetchedAt) {
+					changed[i] = true
+				}
+			}
+		}
+
+		if err := write(os.Stdout, repos, changed); err != nil {
+			return err
+		}
+
+		if *watch <= 0 {
+			return nil
+		}
+
+		previous = map[int]time.Time{}
+		for _, repo := range repos {
+			previous[repo.ID] = repo.FetchedAt
+		}
+
+		time.Sleep(*watch)
+
+		fmt.Println()
+	}
+}
+
+// writers format repositories, given the indexes of
+// those whose fetchedAt changed since the last poll.
+var writers = map[string]func(io.Writer, []models.Repository, map[int]bool) error{
+	"table": writeTable,
+	"json":  writeJSON,
+	"csv":   writeCSV,
+}
+
+func writeTable(w io.Writer, repos []models.Repository, changed map[int]bool) error {
+	var (
+		buf bytes.Buffer
+		tw  = tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	)
+
+	fmt.Fprintln(tw, "ID\tNAME\tFETCHED AT")
+	for _, repo := range repos {
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", repo.ID, repo.Name, repo.FetchedAt.Format(time.RFC3339Nano))
+	}
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	// highlight after alignment as escape codes would skew column widths
+	lines := strings.SplitAfter(buf.String(), "\n")
+	for i, line := range lines {
+		if changed[i-1] {
+			line = highlight + strings.TrimSuffix(line, "\n") + reset + "\n"
+		}
+
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeJSON(w io.Writer, repos []models.Repository, _ map[int]bool) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(repos)
+}
+
+func writeCSV(w io.Writer, repos []models.Repository, _ map[int]bool) error {
+	cw := csv.NewWriter(w)
+
+	cw.Write([]string{"id", "name", "fetchedAt"})
+	for _, repo := range repos {
+		cw.Write([]string{strconv.Itoa(repo.ID), repo.Name, repo.FetchedAt.Format(time.RFC3339Nano)})
+	}
+
+	cw.Flush()
+
+	return cw.Error()
+}
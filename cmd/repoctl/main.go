@@ -0,0 +1,142 @@
+// Command repoctl queries the repositories proxy served by cmd/repositories.
+//
+//	repoctl get --count 5 --unique
+//	repoctl get --ids 1,3 --output csv
+//	repoctl get --count 3 --watch 2s
+//	repoctl bench --requests 100 --concurrency 10 --count 5
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/georgemac/repositories/pkg/client"
+	"github.com/georgemac/repositories/pkg/models"
+)
+
+const usage = `usage: repoctl <command> [flags]
+
+commands:
+  get    fetch repositories from the proxy
+  bench  fire concurrent requests and print latency percentiles
+
+run "repoctl <command> -h" for the flags of a command
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "get":
+		err = get(args)
+	case "bench":
+		err = bench(args)
+	case "-h", "--help", "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// requestFlags registers the flags shared by every command which
+// describe the request made to the proxy.
+type requestFlags struct {
+	addr      *string
+	apiKey    *string
+	token     *string
+	cacheOnly *bool
+	count     *int
+	unique    *bool
+	stable    *bool
+	ids       *string
+	sort      *string
+	timeout   *time.Duration
+}
+
+func newRequestFlags(set *flag.FlagSet) requestFlags {
+	return requestFlags{
+		addr:      set.String("addr", "http://localhost:8080", "address on which the repositories service is found"),
+		apiKey:    set.String("api-key", os.Getenv("REPOCTL_API_KEY"), "API key presented to the repositories service (default $REPOCTL_API_KEY)"),
+		token:     set.String("token", os.Getenv("REPOCTL_TOKEN"), "bearer token, such as a JWT, presented to the repositories service (default $REPOCTL_TOKEN)"),
+		cacheOnly: set.Bool("cache-only", false, "only return repositories the proxy has already fetched"),
+		count:     set.Int("count", 1, "number of repositories to fetch"),
+		unique:    set.Bool("unique", false, "only return unique repositories"),
+		stable:    set.Bool("stable", false, "return repositories in slot order"),
+		ids:       set.String("ids", "", "comma separated repository IDs to fetch"),
+		sort:      set.String("sort", "", "sort by id, name or fetchedAt (prefix with - for descending)"),
+		timeout:   set.Duration("timeout", 0, "time after which the proxy returns what it has collected"),
+	}
+}
+
+func (f requestFlags) client() (*client.Client, error) {
+	var opts []client.Option
+	if *f.apiKey != "" {
+		opts = append(opts, client.WithAPIKey(*f.apiKey))
+	}
+
+	if *f.token != "" {
+		opts = append(opts, client.WithBearerToken(*f.token))
+	}
+
+	return client.New(*f.addr, opts...)
+}
+
+func (f requestFlags) request() (models.RepositoriesRequest, error) {
+	opts := []models.Option{models.WithCount(*f.count)}
+
+	if *f.ids != "" {
+		var ids []int
+		for _, v := range strings.Split(*f.ids, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				return models.RepositoriesRequest{}, fmt.Errorf("invalid id %q", v)
+			}
+
+			ids = append(ids, id)
+		}
+
+		opts = append(opts, models.WithIDs(ids...))
+	}
+
+	if *f.unique {
+		opts = append(opts, models.Unique)
+	}
+
+	if *f.stable {
+		opts = append(opts, models.Stable)
+	}
+
+	if *f.cacheOnly {
+		opts = append(opts, models.CacheOnly)
+	}
+
+	if *f.sort != "" {
+		sort, err := models.ParseSort(*f.sort)
+		if err != nil {
+			return models.RepositoriesRequest{}, err
+		}
+
+		opts = append(opts, models.SortBy(sort))
+	}
+
+	if *f.timeout > 0 {
+		opts = append(opts, models.WithTimeout(*f.timeout))
+	}
+
+	return models.NewRepositoriesRequest(opts...), nil
+}
@@ -1,32 +1,219 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"time"
 
+	"github.com/georgemac/repositories/pkg/config"
+	"github.com/georgemac/repositories/pkg/graceful"
+	"github.com/georgemac/repositories/pkg/logging"
 	"github.com/georgemac/repositories/pkg/repositories"
 	"github.com/georgemac/repositories/pkg/server"
+	"github.com/georgemac/repositories/pkg/tlsconfig"
 )
 
-var (
-	addr              = flag.String("addr", ":8080", "address on which to serve the repositories service")
-	repositoryService = flag.String("repository-addr", "http://localhost:7080", "address on which repository service is found")
-)
+const upstreamTokenHeader = "X-Upstream-Token"
+
+var flags = config.NewFlags(flag.CommandLine)
 
 func main() {
 	flag.Parse()
 
-	service, err := repositories.New(*repositoryService)
+	cfg, err := flags.Load(os.Getenv)
 	if err != nil {
 		log.Fatal(err)
 	}
-	server := server.New(service)
 
-	http.Handle("/repositories", server)
+	if flags.Print {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
+	// the format is validated with the rest of the configuration
+	format, _ := logging.ParseFormat(cfg.LogFormat)
+
+	var (
+		level  = &slog.LevelVar{}
+		logger = logging.New(os.Stderr, format, level)
+	)
+
+	// the standard logger, used by net/http, writes through logger
+	slog.SetDefault(logger)
+
+	ctx, cancel := graceful.Signals(context.Background())
+	defer cancel()
+
+	proxy, err := newProxy(ctx, cfg, logger, level)
+	if err != nil {
+		fatal(logger, "configuring proxy", err)
+	}
+
+	go proxy.reloadOnHangup(ctx)
+
+	http.Handle("/repositories", server.LogRequests(logger, proxy))
+
+	if cfg.AdminToken != "" {
+		http.Handle("/admin/reload", requireToken(cfg.AdminToken, http.HandlerFunc(proxy.handleReload)))
+	}
+
+	srv := &http.Server{Addr: cfg.Addr}
+
+	if cfg.TLS.CertFile != "" {
+		certs, err := tlsconfig.NewReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			fatal(logger, "loading TLS certificate", err)
+		}
+
+		go certs.Watch(ctx, time.Duration(cfg.TLS.ReloadInterval), func(err error) {
+			logger.Error("reloading TLS certificate", "error", err)
+		})
+
+		srv.TLSConfig = certs.Server()
+	}
+
+	logger.Info("listening", "addr", cfg.Addr, "tls", srv.TLSConfig != nil)
+
+	// requests in flight are drained on SIGTERM or interrupt, and
+	// the process exits non-zero if any had to be cancelled
+	if err := graceful.ListenAndServe(ctx, srv, time.Duration(cfg.DrainTimeout)); err != nil {
+		fatal(logger, "serving", err)
+	}
+
+	logger.Info("shut down")
+}
+
+// fatal logs err and exits non-zero.
+func fatal(logger *slog.Logger, msg string, err error) {
+	logger.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// serviceOptions returns the addresses of the repository service and
+// the options of the repositories.Service configured by cfg.
+func serviceOptions(cfg config.Upstream) ([]string, []repositories.Option, error) {
+	var opts []repositories.Option
+	if cfg.TokensFile != "" {
+		tokens, err := repositories.LoadTokens(cfg.TokensFile)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		opts = append(opts, repositories.WithTokens(tokens...))
+	}
+
+	if cfg.ProfilesFile != "" {
+		profiles, err := repositories.LoadProfiles(cfg.ProfilesFile)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		opts = append(opts, repositories.WithProfiles(profiles))
+	}
+
+	if cfg.CAFile != "" || cfg.CertFile != "" {
+		tlsConfig, err := tlsconfig.Client(cfg.CAFile, cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		opts = append(opts, repositories.WithTLSConfig(tlsConfig))
+	}
+
+	balancing, err := repositories.ParseBalancing(cfg.Balancing)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	addresses := cfg.Addresses
+	if cfg.AddressesFile != "" {
+		if addresses, err = repositories.LoadUpstreams(cfg.AddressesFile); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if len(addresses) == 0 {
+		return nil, nil, errors.New("no repository service addresses")
+	}
+
+	opts = append(opts,
+		repositories.WithProfile(cfg.Profile),
+		repositories.WithUpstreams(addresses[1:]...),
+		repositories.WithBalancing(balancing),
+		repositories.WithMaxAttempts(cfg.MaxAttempts),
+		repositories.WithEjection(cfg.EjectAfter, time.Duration(cfg.EjectFor)),
+	)
+
+	return addresses, opts, nil
+}
+
+// authenticator returns the authenticator configured by cfg.
+func authenticator(cfg config.Auth) (server.Authenticator, error) {
+	var authenticators server.Authenticators
+	if cfg.APIKeysFile != "" {
+		keys, err := server.LoadAPIKeys(cfg.APIKeysFile)
+		if err != nil {
+			return nil, err
+		}
+
+		authenticators = append(authenticators, keys)
+	}
+
+	if cfg.JWT() {
+		jwt := server.JWT{
+			Issuer:   cfg.JWTIssuer,
+			Audience: cfg.JWTAudience,
+			Leeway:   time.Duration(cfg.JWTLeeway),
+		}
+
+		if cfg.JWTSecretFile != "" {
+			secret, err := ioutil.ReadFile(cfg.JWTSecretFile)
+			if err != nil {
+				return nil, err
+			}
+
+			// an empty secret would verify tokens signed with no key
+			if jwt.HMACSecret = bytes.TrimSpace(secret); len(jwt.HMACSecret) == 0 {
+				return nil, fmt.Errorf("%s: empty JSON Web Token secret", cfg.JWTSecretFile)
+			}
+		}
+
+		if cfg.JWTPublicKeyFile != "" {
+			key, err := server.LoadRSAPublicKey(cfg.JWTPublicKeyFile)
+			if err != nil {
+				return nil, err
+			}
 
-	fmt.Printf("Listening on %q\n", *addr)
+			jwt.RSAPublicKey = key
+		}
 
-	log.Fatal(http.ListenAndServe(*addr, nil))
+		authenticators = append(authenticators, jwt)
+	}
+
+	return authenticators, nil
+}
+
+// trustUpstream trusts requests presenting token to pass
+// upstream parameters through, or none if token is empty.
+func trustUpstream(token string) func(*http.Request) bool {
+	if token == "" {
+		return nil
+	}
+
+	return func(r *http.Request) bool {
+		presented := r.Header.Get(upstreamTokenHeader)
+		return subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1
+	}
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/georgemac/repositories/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthenticatorSecret(t *testing.T) {
+	for _, testCase := range []struct {
+		Name   string
+		Secret string
+		// expectations
+		ExpectedError bool
+	}{
+		{
+			Name:   "secret",
+			Secret: "s3cr3t\n",
+		},
+		{
+			Name:          "empty secret",
+			ExpectedError: true,
+		},
+		{
+			Name:          "whitespace secret",
+			Secret:        " \n\t\n",
+			ExpectedError: true,
+		},
+	} {
+		t.Run(testCase.Name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "secret")
+			require.Nil(t, ioutil.WriteFile(path, []byte(testCase.Secret), 0600))
+
+			_, err := authenticator(config.Auth{JWTSecretFile: path})
+			if testCase.ExpectedError {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+		})
+	}
+}
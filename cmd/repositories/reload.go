@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/georgemac/repositories/pkg/config"
+	"github.com/georgemac/repositories/pkg/logging"
+	"github.com/georgemac/repositories/pkg/repositories"
+	"github.com/georgemac/repositories/pkg/server"
+)
+
+// proxy serves /repositories with the server built from the current
+// configuration. Reloading the configuration builds a new service and
+// server and swaps them in, so requests in flight complete unaffected.
+type proxy struct {
+	ctx    context.Context
+	logger *slog.Logger
+	level  *slog.LevelVar
+
+	mu sync.Mutex
+	// guarded by mu
+	cfg     config.Config
+	service *repositories.Service
+	stop    context.CancelFunc
+
+	// current holds the handler requests are served by
+	current atomic.Value
+}
+
+// handler wraps the current handler as an atomic.Value
+// must always hold values of the same type.
+type handler struct {
+	http.Handler
+}
+
+// newProxy builds the service and server configured by cfg,
+// setting the level of logger as configured.
+func newProxy(ctx context.Context, cfg config.Config, logger *slog.Logger, level *slog.LevelVar) (*proxy, error) {
+	p := &proxy{ctx: ctx, logger: logger, level: level}
+	if err := p.apply(cfg); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// apply builds the service and server configured by cfg and swaps them
+// in, the new service inheriting the cache of the one it replaces.
+func (p *proxy) apply(cfg config.Config) error {
+	level, err := logging.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+
+	addresses, opts, err := serviceOptions(cfg.Upstream)
+	if err != nil {
+		return err
+	}
+
+	if p.service != nil {
+		opts = append(opts, repositories.Inherit(p.service))
+	}
+
+	service, err := repositories.New(addresses[0], opts...)
+	if err != nil {
+		return err
+	}
+
+	srv := server.New(service)
+	srv.TrustUpstream = trustUpstream(cfg.Server.UpstreamParamsToken)
+	srv.MaxCount = cfg.Server.MaxCount
+
+	var h http.Handler = srv
+	if cfg.Auth.Enabled() {
+		authenticator, err := authenticator(cfg.Auth)
+		if err != nil {
+			return err
+		}
+
+		h = server.Authenticate(authenticator, srv)
+	}
+
+	// the watcher of the previous service is replaced
+	// by one updating the new service
+	ctx, stop := context.WithCancel(p.ctx)
+	if cfg.Upstream.AddressesFile != "" {
+		go service.WatchUpstreams(ctx, cfg.Upstream.AddressesFile, time.Duration(cfg.Upstream.AddressesInterval), func(err error) {
+			p.logger.Error("watching repository service addresses", "error", err)
+		})
+	}
+
+	if p.stop != nil {
+		p.stop()
+	}
+
+	p.level.Set(level)
+	p.cfg, p.service, p.stop = cfg, service, stop
+	p.current.Store(handler{h})
+
+	return nil
+}
+
+func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.current.Load().(handler).ServeHTTP(w, r)
+}
+
+// reload loads the configuration again and applies it, returning the
+// changes made. The configuration in use is kept if it is invalid, and
+// settings which only take effect on restart keep their running values.
+func (p *proxy) reload() ([]config.Change, error) {
+	cfg, err := flags.Load(os.Getenv)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	changes := config.Diff(p.cfg, cfg)
+	if err := p.apply(cfg.KeepRestart(p.cfg)); err != nil {
+		return nil, err
+	}
+
+	for _, change := range changes {
+		p.logger.Info("config changed", "setting", change.Setting, "from", change.From, "to", change.To, "reloaded", change.Reloaded, "restart", change.Restart)
+	}
+
+	return changes, nil
+}
+
+// reloadOnHangup reloads the configuration on every SIGHUP until ctx is done.
+func (p *proxy) reloadOnHangup(ctx context.Context) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+		}
+
+		if _, err := p.reload(); err != nil {
+			p.logger.Error("reloading config", "error", err)
+		}
+	}
+}
+
+// handleReload reloads the configuration on POST and
+// responds with the changes made as JSON.
+func (p *proxy) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	changes, err := p.reload()
+	if err != nil {
+		p.logger.Error("reloading config", "error", err)
+
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if changes == nil {
+		changes = []config.Change{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"changes": changes})
+}
+
+// requireToken responds 401 to requests which do not present token as a bearer token.
+func requireToken(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+
+		presented := strings.TrimPrefix(auth, "Bearer ")
+		if presented == auth || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/georgemac/repositories/pkg/codehost"
+	"github.com/georgemac/repositories/pkg/config"
+	"github.com/georgemac/repositories/pkg/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReload(t *testing.T) {
+	var (
+		testService = codehost.New(codehost.WithBehaviour(codehost.Behaviour{}))
+		testServer  = httptest.NewServer(testService)
+		keys        = filepath.Join(t.TempDir(), "keys.json")
+		level       = &slog.LevelVar{}
+	)
+
+	defer testServer.Close()
+
+	require.Nil(t, ioutil.WriteFile(keys, []byte(`[{"key": "first", "name": "ci"}]`), 0644))
+
+	t.Setenv("REPOSITORIES_REPOSITORY_ADDR", testServer.URL)
+	t.Setenv("REPOSITORIES_API_KEYS_FILE", keys)
+	t.Setenv("REPOSITORIES_ADDR", ":8081")
+
+	cfg, err := flags.Load(os.Getenv)
+	require.Nil(t, err)
+
+	p, err := newProxy(context.Background(), cfg, slog.New(slog.DiscardHandler), level)
+	require.Nil(t, err)
+
+	get := func(key string) int {
+		req := httptest.NewRequest(http.MethodGet, "/repositories", nil)
+		req.Header.Set(server.APIKeyHeader, key)
+
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, get("first"))
+	assert.Equal(t, http.StatusUnauthorized, get("second"))
+
+	// the keys are replaced in the file of the same name
+	require.Nil(t, ioutil.WriteFile(keys, []byte(`[{"key": "second", "name": "ci"}]`), 0644))
+
+	t.Setenv("REPOSITORIES_ADDR", ":9090")
+	t.Setenv("REPOSITORIES_LOG_LEVEL", "debug")
+
+	rec := httptest.NewRecorder()
+	p.handleReload(rec, httptest.NewRequest(http.MethodPost, "/admin/reload", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var body struct {
+		Changes []config.Change `json:"changes"`
+	}
+
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&body))
+
+	assert.Equal(t, []config.Change{
+		{Setting: "addr", From: ":8081", To: ":9090", Restart: true},
+		{Setting: "api-keys-file", From: keys, To: keys, Reloaded: true},
+		{Setting: "log-level", From: "info", To: "debug"},
+	}, body.Changes)
+
+	assert.Equal(t, http.StatusUnauthorized, get("first"))
+	assert.Equal(t, http.StatusOK, get("second"))
+	assert.Equal(t, slog.LevelDebug, level.Level())
+
+	// the address only changes on restart so is still reported
+	assert.Equal(t, ":8081", p.cfg.Addr)
+
+	rec = httptest.NewRecorder()
+	p.handleReload(rec, httptest.NewRequest(http.MethodPost, "/admin/reload", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&body))
+
+	assert.Equal(t, []config.Change{
+		{Setting: "addr", From: ":8081", To: ":9090", Restart: true},
+	}, body.Changes)
+}
+
+func TestRequireToken(t *testing.T) {
+	handler := requireToken("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for _, testCase := range []struct {
+		Name          string
+		Authorization string
+		// expectations
+		ExpectedStatus int
+	}{
+		{
+			Name:           "token",
+			Authorization:  "Bearer secret",
+			ExpectedStatus: http.StatusNoContent,
+		},
+		{
+			Name:           "no token",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Name:           "wrong token",
+			Authorization:  "Bearer secrets",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Name:           "token without scheme",
+			Authorization:  "secret",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+	} {
+		t.Run(testCase.Name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/admin/reload", nil)
+			if testCase.Authorization != "" {
+				req.Header.Set("Authorization", testCase.Authorization)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, testCase.ExpectedStatus, rec.Code)
+			if testCase.ExpectedStatus == http.StatusUnauthorized {
+				assert.Equal(t, `Bearer realm="admin"`, rec.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
@@ -4,46 +4,97 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"flag"
 	"fmt"
 	"html/template"
 	"log"
-	"math/rand"
 	"net/http"
 	"os"
-	"strconv"
-	"time"
+	"strings"
+
+	"github.com/georgemac/repositories/pkg/codehost"
+	"github.com/georgemac/repositories/pkg/graceful"
+	"github.com/georgemac/repositories/pkg/logging"
 )
 
-var colors = []string{
-	"red",
-	"orange",
-	"yellow",
-	"green",
-	"indigo",
-	"violet",
-	"", // intentionally empty
-}
+var (
+	port string
+
+	seed          = flag.Int64("seed", 0, "seed for picking repositories and misbehaving (default random)")
+	scenario      = flag.String("scenario", "", "path to a JSON scenario describing how behaviour changes over time")
+	catalogue     = flag.String("catalogue", "", "path to a JSON or CSV file of repositories to serve")
+	catalogueSize = flag.Int("catalogue-size", 10, "number of repositories to serve when no -catalogue is given")
+	names         = flag.String("names", "", "comma separated names cycled through when generating repositories (default colors)")
+	tokens        = flag.String("tokens", "", "comma separated bearer tokens, each optionally suffixed with :quota, required to call the API")
+	tokensFile    = flag.String("tokens-file", "", "path to a file of bearer tokens, one per line, required to call the API")
+	drainTimeout  = flag.Duration("drain-timeout", graceful.DefaultDrainTimeout, "how long requests in flight are given to complete on shutdown before they are cancelled")
+)
 
-type repository struct {
-	ID        int       `json:"id,omitempty"`
-	Name      string    `json:"name,omitempty"`
-	FetchedAt time.Time `json:"fetchedAt,omitempty"`
-}
+func main() {
+	flag.Parse()
 
-var repositories []repository
+	var opts []codehost.Option
 
-var port string
+	// any seed, including 0, is used once given
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "seed" {
+			opts = append(opts, codehost.WithSeed(*seed))
+		}
+	})
 
-func main() {
-	// Initialize more repositories than unique names.
-	for i := 0; i < 10; i++ {
-		repositories = append(repositories, repository{
-			ID:   i + 1,
-			Name: colors[i%len(colors)],
-		})
+	if *scenario != "" {
+		sc, err := codehost.LoadScenario(*scenario)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		opts = append(opts, codehost.WithScenario(sc))
+	}
+
+	if *catalogue != "" {
+		repos, err := codehost.LoadRepositories(*catalogue)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		opts = append(opts, codehost.WithRepositories(repos...))
+	} else {
+		var generated []string
+		if *names != "" {
+			generated = strings.Split(*names, ",")
+		}
+
+		opts = append(opts, codehost.WithRepositories(codehost.GenerateRepositories(*catalogueSize, generated)...))
+	}
+
+	var accepted []codehost.Token
+	if *tokens != "" {
+		for _, v := range strings.Split(*tokens, ",") {
+			token, err := codehost.ParseToken(v)
+			if err != nil {
+				log.Fatalln(err)
+			}
+
+			accepted = append(accepted, token)
+		}
+	}
+
+	if *tokensFile != "" {
+		loaded, err := codehost.LoadTokens(*tokensFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		accepted = append(accepted, loaded...)
 	}
 
+	if len(accepted) > 0 {
+		opts = append(opts, codehost.WithTokens(accepted...))
+	}
+
+	host := codehost.New(opts...)
+
 	port = os.Getenv("PORT")
 	if port == "" {
 		port = "7080"
@@ -51,10 +102,38 @@ func main() {
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", handleInstructions)
-	mux.HandleFunc("/repository", handleGetRepository)
+	mux.Handle("/repository", host)
+	mux.Handle("/repositories", host)
+	mux.Handle("/admin/", host)
+
+	ctx, cancel := graceful.Signals(context.Background())
+	defer cancel()
 
 	log.Println("listening on http://localhost:" + port)
-	log.Fatalln(http.ListenAndServe(":"+port, mux))
+
+	// stalled requests only return once they are cancelled at the drain timeout
+	if err := graceful.ListenAndServe(ctx, &http.Server{Addr: ":" + port, Handler: logIDs(mux)}, *drainTimeout); err != nil {
+		log.Fatalln(err)
+	}
+
+	log.Println("shut down")
+}
+
+// logIDs logs the request ID and trace context of the
+// requests served by next which were made with either.
+func logIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			id    = r.Header.Get(logging.RequestIDHeader)
+			trace = r.Header.Get(logging.TraceparentHeader)
+		)
+
+		if id != "" || trace != "" {
+			log.Printf("%s %s requestID=%q traceparent=%q", r.Method, r.URL.Path, id, trace)
+		}
+
+		next.ServeHTTP(w, r)
+	})
 }
 
 var instructionsTemplate = template.Must(template.New("").Parse(`
@@ -114,133 +193,3 @@ func handleInstructions(w http.ResponseWriter, r *http.Request) {
 		log.Println(err)
 	}
 }
-
-func handleGetRepository(w http.ResponseWriter, r *http.Request) {
-	id, err := idFormValue(r)
-	if err != nil {
-		writeError(w, err)
-		return
-	}
-	repo := repositories[id-1]
-	repo.FetchedAt = time.Now() // we are modifying a copy of the repo
-	if err := misbehave(w, r, &repo); err != nil {
-		writeError(w, err)
-		return
-	}
-	writeJSON(w, map[string]interface{}{
-		"repository": repo,
-	})
-}
-
-func idFormValue(r *http.Request) (int, error) {
-	id := r.FormValue("id")
-	if id == "" {
-		return rand.Intn(len(repositories)) + 1, nil
-	}
-	i, err := strconv.Atoi(id)
-	if err != nil {
-		return 0, &httpError{
-			status:  http.StatusBadRequest,
-			message: err.Error(),
-		}
-	}
-	return i, nil
-}
-
-func misbehave(w http.ResponseWriter, r *http.Request, repo *repository) error {
-	latency := r.FormValue("latency")
-	if latency == "" {
-		latency = "500ms"
-	}
-	d, err := time.ParseDuration(latency)
-	if err != nil {
-		return err
-	}
-	time.Sleep(d)
-
-	failRatio := r.FormValue("failRatio")
-	if failRatio != "" {
-		f, err := strconv.ParseFloat(failRatio, 64)
-		if err != nil {
-			return err
-		}
-		if rand.Float64() < f {
-			switch rand.Intn(3) {
-			case 0:
-				r.Form.Set("panicRatio", "1")
-			case 1:
-				r.Form.Set("errorRatio", "1")
-			case 2:
-				r.Form.Set("garbageRatio", "1")
-			default:
-				panic("bug")
-			}
-		}
-	}
-
-	panicRatio := r.FormValue("panicRatio")
-	if panicRatio != "" {
-		f, err := strconv.ParseFloat(panicRatio, 64)
-		if err != nil {
-			return err
-		}
-		if rand.Float64() < f {
-			panic("random panic!")
-		}
-	}
-
-	errorRatio := r.FormValue("errorRatio")
-	if errorRatio != "" {
-		f, err := strconv.ParseFloat(errorRatio, 64)
-		if err != nil {
-			return err
-		}
-		if rand.Float64() < f {
-			return &httpError{
-				status:  http.StatusInternalServerError,
-				message: "random error!",
-			}
-		}
-	}
-
-	garbageRatio := r.FormValue("garbageRatio")
-	if garbageRatio != "" {
-		f, err := strconv.ParseFloat(garbageRatio, 64)
-		if err != nil {
-			return err
-		}
-		if rand.Float64() < f {
-			w.Write([]byte("random garbage!"))
-		}
-	}
-
-	return nil
-}
-
-func writeJSON(w http.ResponseWriter, v interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(v); err != nil {
-		panic(err)
-	}
-}
-
-func writeError(w http.ResponseWriter, err error) {
-	switch x := err.(type) {
-	case *httpError:
-		w.WriteHeader(x.status)
-	default:
-		w.WriteHeader(http.StatusInternalServerError)
-	}
-	writeJSON(w, map[string]string{
-		"error": err.Error(),
-	})
-}
-
-type httpError struct {
-	status  int
-	message string
-}
-
-func (err *httpError) Error() string {
-	return err.message
-}
@@ -0,0 +1,227 @@
+// Package client provides a Go client for the /repositories API
+// served by cmd/repositories.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/georgemac/repositories/pkg/models"
+)
+
+// Error is returned when the server responds with a non-2xx status.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("repositories: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Temporary reports whether the request may succeed if retried.
+func (e *Error) Temporary() bool {
+	return e.StatusCode >= http.StatusInternalServerError || e.StatusCode == http.StatusTooManyRequests
+}
+
+type Client struct {
+	cli    *http.Client
+	target *url.URL
+	header http.Header
+}
+
+type Option func(c *Client)
+
+// WithHTTPClient configures the http.Client used to make requests.
+func WithHTTPClient(cli *http.Client) Option {
+	return func(c *Client) {
+		c.cli = cli
+	}
+}
+
+// WithAPIKey authenticates requests with a static API key.
+func WithAPIKey(key string) Option {
+	return func(c *Client) {
+		c.header.Set("X-API-Key", key)
+	}
+}
+
+// WithBearerToken authenticates requests with a bearer token, such as a JWT.
+func WithBearerToken(token string) Option {
+	return func(c *Client) {
+		c.header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+func New(repositoriesServiceAddress string, opts ...Option) (*Client, error) {
+	url, err := url.Parse(repositoriesServiceAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		cli:    &http.Client{},
+		target: url,
+		header: http.Header{},
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c, nil
+}
+
+// Get fetches repositories for a request built from opts.
+func (c *Client) Get(ctx context.Context, opts ...models.Option) ([]models.Repository, error) {
+	return c.Repositories(ctx, models.NewRepositoriesRequest(opts...))
+}
+
+// Repositories fetches the repositories described by req.
+// It implements server.RepositoriesService.
+func (c *Client) Repositories(ctx context.Context, req models.RepositoriesRequest) ([]models.Repository, error) {
+	resp, err := c.do(ctx, req, "application/json")
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	var repos []models.Repository
+	if err := json.NewDecoder(resp.Body).Decode(&repos); err != nil {
+		return nil, err
+	}
+
+	return repos, nil
+}
+
+// StreamRepositories requests a newline delimited JSON response and calls
+// fn with each repository as it arrives. It implements server.RepositoriesStreamer.
+// Repositories arrive in the order they are collected, so the server
+// rejects requests which set Sort or Stable.
+func (c *Client) StreamRepositories(ctx context.Context, req models.RepositoriesRequest, fn func(models.Event) error) error {
+	resp, err := c.do(ctx, req, "application/x-ndjson")
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for slot := 0; scanner.Scan(); slot++ {
+		var line struct {
+			models.Repository
+			Error *string `json:"error"`
+		}
+
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return err
+		}
+
+		if line.Error != nil {
+			return &Error{StatusCode: http.StatusInternalServerError, Message: *line.Error}
+		}
+
+		if err := fn(models.Event{
+			Type:       models.EventRepository,
+			Slot:       slot,
+			Repository: line.Repository,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (c *Client) do(ctx context.Context, req models.RepositoriesRequest, accept string) (*http.Response, error) {
+	target, err := c.target.Parse("/repositories")
+	if err != nil {
+		return nil, err
+	}
+
+	target.RawQuery = Query(req).Encode()
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range c.header {
+		httpReq.Header[k] = v
+	}
+
+	httpReq.Header.Set("Accept", accept)
+
+	resp, err := c.cli.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+
+		return nil, &Error{
+			StatusCode: resp.StatusCode,
+			Message:    string(bytes.TrimSpace(body)),
+		}
+	}
+
+	return resp, nil
+}
+
+// Query encodes req as /repositories query parameters.
+func Query(req models.RepositoriesRequest) url.Values {
+	query := url.Values{}
+
+	query.Set("count", strconv.Itoa(req.Count))
+
+	if len(req.IDs) > 0 {
+		ids := make([]string, 0, len(req.IDs))
+		for _, id := range req.IDs {
+			ids = append(ids, strconv.Itoa(id))
+		}
+
+		query.Set("ids", strings.Join(ids, ","))
+	}
+
+	if req.Unique {
+		query.Set("unique", "true")
+	}
+
+	if req.Stable {
+		query.Set("stable", "true")
+	}
+
+	if req.CacheOnly {
+		query.Set("cacheOnly", "true")
+	}
+
+	if req.Sort.Key != "" {
+		query.Set("sort", req.Sort.String())
+	}
+
+	if req.Timeout > 0 {
+		query.Set("timeout", req.Timeout.String())
+	}
+
+	if req.UpstreamProfile != "" {
+		query.Set("upstream.profile", req.UpstreamProfile)
+	}
+
+	for param, values := range req.UpstreamParams {
+		query["upstream."+param] = values
+	}
+
+	return query
+}
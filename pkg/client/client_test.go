@@ -0,0 +1,121 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/georgemac/repositories/pkg/models"
+	"github.com/georgemac/repositories/pkg/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	_ server.RepositoriesService  = (*Client)(nil)
+	_ server.RepositoriesStreamer = (*Client)(nil)
+
+	repoA = models.Repository{ID: 1, Name: "foo", FetchedAt: time.Now().UTC()}
+	repoB = models.Repository{ID: 2, Name: "bar", FetchedAt: time.Now().UTC()}
+)
+
+type repositoriesService struct {
+	request models.RepositoriesRequest
+	repos   []models.Repository
+	err     error
+}
+
+func (s *repositoriesService) Repositories(_ context.Context, req models.RepositoriesRequest) ([]models.Repository, error) {
+	s.request = req
+	return s.repos, s.err
+}
+
+func (s *repositoriesService) StreamRepositories(_ context.Context, req models.RepositoriesRequest, fn func(models.Event) error) error {
+	s.request = req
+
+	for i, repo := range s.repos {
+		if err := fn(models.Event{Type: models.EventRepository, Slot: i, Repository: repo}); err != nil {
+			return err
+		}
+	}
+
+	return s.err
+}
+
+func TestClient(t *testing.T) {
+	for _, testCase := range []struct {
+		Name string
+		// inputs
+		Service *repositoriesService
+		Options []models.Option
+		Stream  bool
+		// expectations
+		ExpectedRequest      models.RepositoriesRequest
+		ExpectedRepositories []models.Repository
+		ExpectedStatusCode   int
+	}{
+		{
+			Name:                 "fetch repositories",
+			Service:              &repositoriesService{repos: []models.Repository{repoA, repoB}},
+			Options:              []models.Option{models.WithCount(2), models.Unique, models.WithTimeout(time.Second)},
+			ExpectedRequest:      models.NewRepositoriesRequest(models.WithCount(2), models.Unique, models.WithTimeout(time.Second)),
+			ExpectedRepositories: []models.Repository{repoA, repoB},
+		},
+		{
+			Name:                 "stream repositories",
+			Service:              &repositoriesService{repos: []models.Repository{repoA, repoB}},
+			Options:              []models.Option{models.WithCount(2), models.SortBy(models.Sort{Key: models.SortByName, Descending: true})},
+			Stream:               true,
+			ExpectedRequest:      models.NewRepositoriesRequest(models.WithCount(2), models.SortBy(models.Sort{Key: models.SortByName, Descending: true})),
+			ExpectedRepositories: []models.Repository{repoA, repoB},
+		},
+		{
+			Name:               "server error",
+			Service:            &repositoriesService{err: errors.New("boom")},
+			ExpectedRequest:    models.NewRepositoriesRequest(),
+			ExpectedStatusCode: http.StatusInternalServerError,
+		},
+		{
+			Name:               "invalid request",
+			Service:            &repositoriesService{},
+			Options:            []models.Option{models.WithCount(-1)},
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(testCase.Name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.Handle("/repositories", server.New(testCase.Service))
+
+			testServer := httptest.NewServer(mux)
+			defer testServer.Close()
+
+			cli, err := New(testServer.URL)
+			require.Nil(t, err)
+
+			var repos []models.Repository
+			if testCase.Stream {
+				err = cli.StreamRepositories(context.TODO(), models.NewRepositoriesRequest(testCase.Options...), func(ev models.Event) error {
+					repos = append(repos, ev.Repository)
+					return nil
+				})
+			} else {
+				repos, err = cli.Get(context.TODO(), testCase.Options...)
+			}
+
+			if testCase.ExpectedStatusCode != 0 {
+				var clientErr *Error
+				require.True(t, errors.As(err, &clientErr))
+				assert.Equal(t, testCase.ExpectedStatusCode, clientErr.StatusCode)
+				return
+			}
+
+			require.Nil(t, err)
+
+			assert.Equal(t, testCase.ExpectedRequest, testCase.Service.request)
+			assert.Equal(t, testCase.ExpectedRepositories, repos)
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package codehost
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Stats describes the calls served by the code host.
+type Stats struct {
+	Calls int `json:"calls"`
+	// Failures counts the failures injected by type,
+	// e.g. "error", "stall" or "truncate".
+	Failures map[string]int `json:"failures"`
+	// IDs counts the repositories served by ID.
+	IDs map[int]int `json:"ids"`
+}
+
+// Behaviour returns the behaviour used when no scenario is running
+// and a request does not override it with query parameters.
+func (s *Server) Behaviour() Behaviour {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.behaviour
+}
+
+// SetBehaviour replaces the behaviour returned by Behaviour.
+func (s *Server) SetBehaviour(b Behaviour) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.behaviour = b
+}
+
+func (s *Server) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := Stats{
+		Calls:    s.calls,
+		Failures: map[string]int{},
+		IDs:      map[int]int{},
+	}
+
+	for failure, count := range s.failures {
+		stats.Failures[failure] = count
+	}
+
+	for id, count := range s.served {
+		stats.IDs[id] = count
+	}
+
+	return stats
+}
+
+func (s *Server) injected(failure string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures[failure]++
+}
+
+func (s *Server) servedID(id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.served[id]++
+}
+
+// handleConfig reports the behaviour on GET, replaces it on PUT and
+// updates only the fields present in the body on PATCH.
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPatch:
+		var b Behaviour
+		if r.Method == http.MethodPatch {
+			b = s.Behaviour()
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+			writeError(w, &httpError{status: http.StatusBadRequest, message: err.Error()})
+			return
+		}
+
+		s.SetBehaviour(b)
+	default:
+		writeError(w, &httpError{status: http.StatusMethodNotAllowed, message: "method not allowed"})
+		return
+	}
+
+	writeJSON(w, s.Behaviour())
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, &httpError{status: http.StatusMethodNotAllowed, message: "method not allowed"})
+		return
+	}
+
+	writeJSON(w, s.Stats())
+}
@@ -0,0 +1,139 @@
+package codehost
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Token is a bearer token accepted by the code host. A Quota greater
+// than zero limits the number of calls which can be made with it.
+type Token struct {
+	Value string
+	Quota int
+}
+
+// ParseToken parses a token of the form value or value:quota. Only a
+// trailing colon followed by digits is a quota, so values may contain
+// colons of their own.
+func ParseToken(v string) (Token, error) {
+	v = strings.TrimSpace(v)
+
+	i := strings.LastIndex(v, ":")
+	if i < 0 || !isDigits(v[i+1:]) {
+		return Token{Value: v}, nil
+	}
+
+	quota, err := strconv.Atoi(v[i+1:])
+	if err != nil {
+		return Token{}, fmt.Errorf("invalid token quota: %v", err)
+	}
+
+	return Token{Value: v[:i], Quota: quota}, nil
+}
+
+func isDigits(v string) bool {
+	if v == "" {
+		return false
+	}
+
+	for _, r := range v {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// LoadTokens reads one token per line from path in the form accepted
+// by ParseToken, skipping blank lines and lines starting with #.
+func LoadTokens(path string) (tokens []Token, err error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer fi.Close()
+
+	scanner := bufio.NewScanner(fi)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		token, err := ParseToken(line)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, token)
+	}
+
+	return tokens, scanner.Err()
+}
+
+// WithTokens requires calls to the code host API to present one of
+// tokens as a bearer token. Calls without a valid token are rejected
+// with 401 Unauthorized and calls beyond a token's quota are rejected
+// with 403 Forbidden.
+func WithTokens(tokens ...Token) Option {
+	return func(s *Server) {
+		for _, token := range tokens {
+			s.tokens[token.Value] = &tokenUsage{quota: token.Quota}
+		}
+	}
+}
+
+type tokenUsage struct {
+	quota int
+	used  int
+}
+
+// authenticate rejects calls without a valid token when tokens are configured.
+func (s *Server) authenticate(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := s.consume(r); err != nil {
+			if err.status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="codehost"`)
+			}
+
+			writeError(w, err)
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+// consume consumes one call from the quota of the token presented by r.
+func (s *Server) consume(r *http.Request) *httpError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.tokens) == 0 {
+		return nil
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return &httpError{status: http.StatusUnauthorized, message: "missing bearer token"}
+	}
+
+	usage, ok := s.tokens[strings.TrimPrefix(auth, "Bearer ")]
+	if !ok {
+		return &httpError{status: http.StatusUnauthorized, message: "invalid bearer token"}
+	}
+
+	if usage.quota > 0 && usage.used >= usage.quota {
+		return &httpError{status: http.StatusForbidden, message: "token quota exceeded"}
+	}
+
+	usage.used++
+
+	return nil
+}
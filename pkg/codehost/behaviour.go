@@ -0,0 +1,293 @@
+package codehost
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// slowBodyDelay is the delay between each byte of a slow body.
+	slowBodyDelay = 20 * time.Millisecond
+	// oversizeBytes is the amount of padding added to an oversized body.
+	oversizeBytes = 10 << 20
+)
+
+// Behaviour describes how the code host misbehaves when serving a
+// repository. Each ratio is the probability of that failure occurring.
+// It is encoded as JSON in the same form as the query parameters,
+// e.g. {"latency": "normal(2s,200ms)", "errorRatio": 1}.
+type Behaviour struct {
+	Latency Latency `json:"latency"`
+	// FailRatio triggers one of a panic, an error or garbage.
+	FailRatio    float64 `json:"failRatio,omitempty"`
+	PanicRatio   float64 `json:"panicRatio,omitempty"`
+	ErrorRatio   float64 `json:"errorRatio,omitempty"`
+	GarbageRatio float64 `json:"garbageRatio,omitempty"`
+	// TooManyRequestsRatio responds 429 with a Retry-After header.
+	TooManyRequestsRatio float64 `json:"tooManyRequestsRatio,omitempty"`
+	// UnavailableRatio responds 503 with a maintenance page.
+	UnavailableRatio float64 `json:"unavailableRatio,omitempty"`
+	// StallRatio never responds, holding the connection open
+	// until the client gives up.
+	StallRatio float64 `json:"stallRatio,omitempty"`
+	// RedirectRatio redirects to the same repository.
+	RedirectRatio float64 `json:"redirectRatio,omitempty"`
+	// TruncateRatio cuts the JSON body short.
+	TruncateRatio float64 `json:"truncateRatio,omitempty"`
+	// SlowBodyRatio writes the body a byte at a time.
+	SlowBodyRatio float64 `json:"slowBodyRatio,omitempty"`
+	// WrongContentTypeRatio labels the JSON body as text/html.
+	WrongContentTypeRatio float64 `json:"wrongContentTypeRatio,omitempty"`
+	// OversizeRatio pads the body with megabytes of whitespace.
+	OversizeRatio float64 `json:"oversizeRatio,omitempty"`
+}
+
+// DefaultBehaviour is well behaved with a latency of 500ms.
+var DefaultBehaviour = Behaviour{Latency: Fixed(500 * time.Millisecond)}
+
+// ratios returns each ratio of b keyed by its query parameter.
+func (b *Behaviour) ratios() map[string]*float64 {
+	return map[string]*float64{
+		"failRatio":             &b.FailRatio,
+		"panicRatio":            &b.PanicRatio,
+		"errorRatio":            &b.ErrorRatio,
+		"garbageRatio":          &b.GarbageRatio,
+		"tooManyRequestsRatio":  &b.TooManyRequestsRatio,
+		"unavailableRatio":      &b.UnavailableRatio,
+		"stallRatio":            &b.StallRatio,
+		"redirectRatio":         &b.RedirectRatio,
+		"truncateRatio":         &b.TruncateRatio,
+		"slowBodyRatio":         &b.SlowBodyRatio,
+		"wrongContentTypeRatio": &b.WrongContentTypeRatio,
+		"oversizeRatio":         &b.OversizeRatio,
+	}
+}
+
+// override returns a copy of b updated with any behaviour
+// set through the query parameters of r.
+func (b Behaviour) override(r *http.Request) (Behaviour, error) {
+	if latency := r.FormValue("latency"); latency != "" {
+		l, err := ParseLatency(latency)
+		if err != nil {
+			return b, err
+		}
+
+		b.Latency = l
+	}
+
+	for param, ratio := range b.ratios() {
+		v := r.FormValue(param)
+		if v == "" {
+			continue
+		}
+
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return b, err
+		}
+
+		*ratio = f
+	}
+
+	return b, nil
+}
+
+// recorder records the failures injected and repositories served.
+type recorder interface {
+	injected(failure string)
+	servedID(id int)
+}
+
+// payload is the successful response to a call.
+type payload struct {
+	body map[string]interface{}
+	// ids identifies the repositories in body
+	ids []int
+	// etag and lastModified validate a single repository
+	// and are used to evaluate conditional requests
+	etag         string
+	lastModified time.Time
+}
+
+// notModified reports whether the conditional request r can
+// be answered with 304 Not Modified. Only requests for a
+// specific repository are evaluated.
+func (p payload) notModified(r *http.Request) bool {
+	if p.etag == "" || r.FormValue("id") == "" {
+		return false
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, etag := range strings.Split(inm, ",") {
+			etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+			if etag == p.etag || etag == "*" {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	return !p.lastModified.Truncate(time.Second).After(ims)
+}
+
+// serve writes p to w misbehaving as described by b.
+func (b Behaviour) serve(w http.ResponseWriter, r *http.Request, rnd source, p payload, rec recorder) error {
+	time.Sleep(b.Latency.sample(rnd))
+
+	if rnd.Float64() < b.FailRatio {
+		switch rnd.Intn(3) {
+		case 0:
+			b.PanicRatio = 1
+		case 1:
+			b.ErrorRatio = 1
+		case 2:
+			b.GarbageRatio = 1
+		default:
+			panic("bug")
+		}
+	}
+
+	if rnd.Float64() < b.PanicRatio {
+		rec.injected("panic")
+
+		panic("random panic!")
+	}
+
+	if rnd.Float64() < b.ErrorRatio {
+		rec.injected("error")
+
+		return &httpError{
+			status:  http.StatusInternalServerError,
+			message: "random error!",
+		}
+	}
+
+	if rnd.Float64() < b.TooManyRequestsRatio {
+		rec.injected("tooManyRequests")
+
+		w.Header().Set("Retry-After", "1")
+
+		return &httpError{
+			status:  http.StatusTooManyRequests,
+			message: "rate limit exceeded!",
+		}
+	}
+
+	if rnd.Float64() < b.UnavailableRatio {
+		rec.injected("unavailable")
+
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("<html><body><h1>Down for maintenance</h1><p>We'll be back shortly.</p></body></html>\n"))
+
+		return nil
+	}
+
+	if rnd.Float64() < b.StallRatio {
+		rec.injected("stall")
+
+		<-r.Context().Done()
+
+		return nil
+	}
+
+	// redirected requests are not redirected again to avoid loops
+	if r.FormValue("redirected") == "" && rnd.Float64() < b.RedirectRatio {
+		rec.injected("redirect")
+
+		query := r.URL.Query()
+		if len(p.ids) == 1 {
+			// redirect to the same repository
+			query.Set("id", strconv.Itoa(p.ids[0]))
+		}
+
+		query.Set("redirected", "true")
+
+		http.Redirect(w, r, r.URL.Path+"?"+query.Encode(), http.StatusTemporaryRedirect)
+
+		return nil
+	}
+
+	for _, id := range p.ids {
+		rec.servedID(id)
+	}
+
+	if p.etag != "" {
+		w.Header().Set("ETag", p.etag)
+		w.Header().Set("Last-Modified", p.lastModified.UTC().Format(http.TimeFormat))
+
+		if p.notModified(r) {
+			w.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+	}
+
+	var (
+		body        = p.body
+		contentType = "application/json"
+	)
+
+	if rnd.Float64() < b.OversizeRatio {
+		rec.injected("oversize")
+
+		body["padding"] = strings.Repeat(" ", oversizeBytes)
+	}
+
+	if rnd.Float64() < b.WrongContentTypeRatio {
+		rec.injected("wrongContentType")
+
+		contentType = "text/html"
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	if rnd.Float64() < b.TruncateRatio {
+		rec.injected("truncate")
+
+		data = data[:len(data)/2]
+	}
+
+	w.Header().Set("Content-Type", contentType)
+
+	if rnd.Float64() < b.GarbageRatio {
+		rec.injected("garbage")
+
+		w.Write([]byte("random garbage!"))
+	}
+
+	if rnd.Float64() < b.SlowBodyRatio {
+		rec.injected("slowBody")
+
+		flusher, _ := w.(http.Flusher)
+		for i := range data {
+			if _, err := w.Write(data[i : i+1]); err != nil {
+				return nil
+			}
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+
+			time.Sleep(slowBodyDelay)
+		}
+
+		return nil
+	}
+
+	w.Write(append(data, '\n'))
+
+	return nil
+}
@@ -0,0 +1,252 @@
+package codehost
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/georgemac/repositories/pkg/models"
+)
+
+// GenerateRepositories returns size repositories with IDs from 1, named
+// by cycling through names or a default set of colors if there are none.
+func GenerateRepositories(size int, names []string) (repos []models.Repository) {
+	if len(names) == 0 {
+		names = colors
+	}
+
+	for i := 0; i < size; i++ {
+		repos = append(repos, models.Repository{
+			ID:   i + 1,
+			Name: names[i%len(names)],
+		})
+	}
+
+	return
+}
+
+// LoadRepositories reads repositories from path. Files with a .csv
+// extension are read as id,name records with an optional header, any
+// other file as a JSON array of {"id": 1, "name": "red"} objects.
+func LoadRepositories(path string) (repos []models.Repository, err error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer fi.Close()
+
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		repos, err = decodeCSV(fi)
+	} else {
+		err = json.NewDecoder(fi).Decode(&repos)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	seen := map[int]struct{}{}
+	for _, repo := range repos {
+		if repo.ID < 1 {
+			return nil, fmt.Errorf("%s: repository IDs must be positive", path)
+		}
+
+		if _, ok := seen[repo.ID]; ok {
+			return nil, fmt.Errorf("%s: duplicate repository ID %d", path, repo.ID)
+		}
+
+		seen[repo.ID] = struct{}{}
+	}
+
+	return repos, nil
+}
+
+func decodeCSV(r io.Reader) (repos []models.Repository, err error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, record := range records {
+		if len(record) != 2 {
+			return nil, fmt.Errorf("line %d: expected id,name", i+1)
+		}
+
+		id, err := strconv.Atoi(strings.TrimSpace(record[0]))
+		if err != nil {
+			if i == 0 {
+				// skip the header
+				continue
+			}
+
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+
+		repos = append(repos, models.Repository{ID: id, Name: record[1]})
+	}
+
+	return
+}
+
+// Repositories returns the catalogue of repositories served.
+func (s *Server) Repositories() []models.Repository {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]models.Repository(nil), s.repositories...)
+}
+
+// AddRepository adds repo to the catalogue, assigning it the next
+// available ID if it has none.
+func (s *Server) AddRepository(repo models.Repository) (models.Repository, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if repo.ID < 0 {
+		return repo, errors.New("repository IDs must be positive")
+	}
+
+	var max int
+	for _, existing := range s.repositories {
+		if existing.ID == repo.ID {
+			return repo, fmt.Errorf("repository %d already exists", repo.ID)
+		}
+
+		if existing.ID > max {
+			max = existing.ID
+		}
+	}
+
+	if repo.ID == 0 {
+		repo.ID = max + 1
+	}
+
+	s.repositories = append(s.repositories, repo)
+	s.modified[repo.ID] = time.Now()
+
+	return repo, nil
+}
+
+// RenameRepository renames the repository identified by id.
+func (s *Server) RenameRepository(id int, name string) (models.Repository, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.repositories {
+		if s.repositories[i].ID == id {
+			s.repositories[i].Name = name
+			s.modified[id] = time.Now()
+
+			return s.repositories[i], true
+		}
+	}
+
+	return models.Repository{}, false
+}
+
+// RemoveRepository removes the repository identified by id.
+func (s *Server) RemoveRepository(id int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.repositories {
+		if s.repositories[i].ID == id {
+			s.repositories = append(s.repositories[:i], s.repositories[i+1:]...)
+			delete(s.modified, id)
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// handleRepository serves repositories on GET and changes the
+// catalogue on POST (add), PUT (rename) and DELETE (remove).
+func (s *Server) handleRepository(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.handleGetRepository(w, r)
+	case http.MethodPost:
+		var repo models.Repository
+		if err := json.NewDecoder(r.Body).Decode(&repo); err != nil {
+			writeError(w, &httpError{status: http.StatusBadRequest, message: err.Error()})
+			return
+		}
+
+		repo, err := s.AddRepository(repo)
+		if err != nil {
+			writeError(w, &httpError{status: http.StatusConflict, message: err.Error()})
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		writeRepository(w, repo)
+	case http.MethodPut:
+		id, err := idFormValue(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		var body struct {
+			Name string `json:"name"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, &httpError{status: http.StatusBadRequest, message: err.Error()})
+			return
+		}
+
+		repo, ok := s.RenameRepository(id, body.Name)
+		if !ok {
+			writeError(w, errNotFound)
+			return
+		}
+
+		writeRepository(w, repo)
+	case http.MethodDelete:
+		id, err := idFormValue(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if !s.RemoveRepository(id) {
+			writeError(w, errNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, &httpError{status: http.StatusMethodNotAllowed, message: "method not allowed"})
+	}
+}
+
+var errNotFound = &httpError{
+	status:  http.StatusNotFound,
+	message: "repository not found",
+}
+
+// idFormValue parses the id query parameter. The body is not parsed as a
+// form since it carries the JSON payload of mutations.
+func idFormValue(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		return 0, &httpError{
+			status:  http.StatusBadRequest,
+			message: err.Error(),
+		}
+	}
+
+	return id, nil
+}
@@ -0,0 +1,333 @@
+// Package codehost simulates a simple code host API which serves
+// repositories from /repository. It can be configured to have high
+// latency and to misbehave in different ways, either through query
+// parameters or by scripting the response to each call. A Server can
+// be mounted in an httptest.Server to test clients of the code host.
+package codehost
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/georgemac/repositories/pkg/models"
+)
+
+var colors = []string{
+	"red",
+	"orange",
+	"yellow",
+	"green",
+	"indigo",
+	"violet",
+	"", // intentionally empty
+}
+
+// DefaultRepositories returns ten repositories with
+// more repositories than unique names.
+func DefaultRepositories() []models.Repository {
+	return GenerateRepositories(10, nil)
+}
+
+type Server struct {
+	mux   *http.ServeMux
+	seed  int64
+	draws atomic.Int64
+	batch bool
+
+	mu           sync.Mutex
+	behaviour    Behaviour
+	repositories []models.Repository
+	script       []Response
+	loop         bool
+	calls        int
+	scenario     *Scenario
+	started      time.Time
+	modified     map[int]time.Time
+	failures     map[string]int
+	served       map[int]int
+	tokens       map[string]*tokenUsage
+}
+
+type Option func(s *Server)
+
+// WithRepositories configures the catalogue of repositories served,
+// which can be changed at runtime through /repository. It defaults
+// to DefaultRepositories.
+func WithRepositories(repos ...models.Repository) Option {
+	return func(s *Server) {
+		// copied so that changes to the catalogue do not alias repos
+		s.repositories = append([]models.Repository(nil), repos...)
+	}
+}
+
+// WithBehaviour configures the behaviour used when no scenario is running
+// and a request does not override it with query parameters. It defaults
+// to DefaultBehaviour and can be changed at runtime through /admin/config.
+func WithBehaviour(b Behaviour) Option {
+	return func(s *Server) {
+		s.behaviour = b
+	}
+}
+
+// WithScript configures the responses to the first calls to /repository,
+// in order. Once the script is exhausted calls are served as normal.
+func WithScript(responses ...Response) Option {
+	return func(s *Server) {
+		s.script = append(s.script, responses...)
+	}
+}
+
+// WithSeed seeds the server's source of randomness so that a given
+// sequence of calls picks the same repositories and misbehaves in the
+// same way. Each call draws from a source derived from the seed and the
+// number of the call, so concurrent calls do not disturb one another.
+// A request can replace the seed with the seed query parameter.
+func WithSeed(seed int64) Option {
+	return func(s *Server) {
+		s.seed = seed
+	}
+}
+
+// WithoutBatch disables the /repositories list endpoint and the
+// /repository?ids= and ?count= batch forms, simulating a code host which only
+// serves a single repository per call.
+func WithoutBatch(s *Server) {
+	s.batch = false
+}
+
+// Loop repeats the script indefinitely rather than exhausting it.
+func Loop(s *Server) {
+	s.loop = true
+}
+
+func New(opts ...Option) *Server {
+	s := &Server{
+		mux:          http.NewServeMux(),
+		behaviour:    DefaultBehaviour,
+		repositories: DefaultRepositories(),
+		seed:         time.Now().UnixNano(),
+		batch:        true,
+		modified:     map[int]time.Time{},
+		failures:     map[string]int{},
+		served:       map[int]int{},
+		tokens:       map[string]*tokenUsage{},
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	now := time.Now()
+	for _, repo := range s.repositories {
+		s.modified[repo.ID] = now
+	}
+
+	s.mux.HandleFunc("/repository", s.authenticate(s.handleRepository))
+	if s.batch {
+		s.mux.HandleFunc("/repositories", s.authenticate(s.handleListRepositories))
+	}
+	s.mux.HandleFunc("/admin/scenario", s.handleScenario)
+	s.mux.HandleFunc("/admin/config", s.handleConfig)
+	s.mux.HandleFunc("/admin/stats", s.handleStats)
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) handleGetRepository(w http.ResponseWriter, r *http.Request) {
+	resp := s.next()
+	if resp.outcome != outcomeDefault {
+		resp.serve(w, r, s)
+		return
+	}
+
+	time.Sleep(resp.latency)
+
+	rnd, err := s.source(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var p payload
+
+	if isBatch(r) && s.batch {
+		var repos []models.Repository
+		if r.FormValue("ids") != "" {
+			repos, err = s.repositoriesByID(r)
+		} else {
+			repos, err = s.randomRepositories(r, rnd)
+		}
+
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		etags := map[string]string{}
+		for i := range repos {
+			repos[i].FetchedAt = time.Now()
+			p.ids = append(p.ids, repos[i].ID)
+			etags[strconv.Itoa(repos[i].ID)] = etag(repos[i])
+		}
+
+		p.body = map[string]interface{}{"repositories": repos, "etags": etags}
+	} else {
+		repo, err := s.repository(r, rnd)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		p.etag, p.lastModified = etag(repo), s.lastModified(repo.ID)
+
+		repo.FetchedAt = time.Now() // we are modifying a copy of the repo
+
+		p.body = map[string]interface{}{"repository": repo}
+		p.ids = []int{repo.ID}
+	}
+
+	b, err := s.currentBehaviour().override(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := b.serve(w, r, rnd, p, s); err != nil {
+		writeError(w, err)
+	}
+}
+
+// next counts the call and returns the scripted response for it,
+// which is the Default response when there is no script.
+func (s *Server) next() Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	defer func() { s.calls++ }()
+
+	switch {
+	case len(s.script) == 0:
+		return Default()
+	case s.loop:
+		return s.script[s.calls%len(s.script)]
+	case s.calls >= len(s.script):
+		return Default()
+	}
+
+	return s.script[s.calls]
+}
+
+// source returns the source of randomness for the call r, derived from
+// the number of the call and the server's seed, or the seed form value
+// if present. Calls forwarded with the same seed therefore still differ
+// from one another, while a sequence of them is reproducible.
+func (s *Server) source(r *http.Request) (source, error) {
+	var (
+		n    = s.draws.Add(1) - 1
+		seed = s.seed
+	)
+
+	if v := r.FormValue("seed"); v != "" {
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, &httpError{
+				status:  http.StatusBadRequest,
+				message: err.Error(),
+			}
+		}
+
+		seed = i
+	}
+
+	return rand.New(rand.NewSource(drawSeed(seed, n))), nil
+}
+
+// repository returns the repository identified by the id
+// form value, or a random repository when it is absent.
+func (s *Server) repository(r *http.Request, rnd source) (models.Repository, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.FormValue("id") == "" {
+		if len(s.repositories) == 0 {
+			return models.Repository{}, errNotFound
+		}
+
+		return s.repositories[rnd.Intn(len(s.repositories))], nil
+	}
+
+	id, err := idFormValue(r)
+	if err != nil {
+		return models.Repository{}, err
+	}
+
+	for _, repo := range s.repositories {
+		if repo.ID == id {
+			return repo, nil
+		}
+	}
+
+	return models.Repository{}, errNotFound
+}
+
+// etag returns a strong entity tag for repo
+// which changes whenever it is renamed.
+func etag(repo models.Repository) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%d:%s", repo.ID, repo.Name)))
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// lastModified returns when the repository identified
+// by id was added to the catalogue or last renamed.
+func (s *Server) lastModified(id int) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.modified[id]
+}
+
+func writeRepository(w http.ResponseWriter, repo models.Repository) {
+	writeJSON(w, map[string]interface{}{
+		"repository": repo,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		panic(err)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	switch x := err.(type) {
+	case *httpError:
+		w.WriteHeader(x.status)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	writeJSON(w, map[string]string{
+		"error": err.Error(),
+	})
+}
+
+type httpError struct {
+	status  int
+	message string
+}
+
+func (err *httpError) Error() string {
+	return err.message
+}
@@ -0,0 +1,540 @@
+package codehost
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/georgemac/repositories/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var repoA = models.Repository{ID: 1, Name: "foo", FetchedAt: time.Now().UTC()}
+
+func TestServer(t *testing.T) {
+	for _, testCase := range []struct {
+		Name string
+		// inputs
+		Options []Option
+		Query   string
+		// expectations
+		ExpectedStatus     int
+		ExpectedRepository *models.Repository
+		ExpectedDropped    bool
+		ExpectedInvalid    bool
+		ExpectedCalls      int
+	}{
+		{
+			Name:               "scripted repository",
+			Options:            []Option{WithScript(Respond(repoA))},
+			ExpectedStatus:     http.StatusOK,
+			ExpectedRepository: &repoA,
+		},
+		{
+			Name:           "scripted failure",
+			Options:        []Option{WithScript(Fail(http.StatusServiceUnavailable))},
+			ExpectedStatus: http.StatusServiceUnavailable,
+		},
+		{
+			Name:            "scripted drop",
+			Options:         []Option{WithScript(Drop())},
+			ExpectedDropped: true,
+		},
+		{
+			Name:               "repository by id",
+			Options:            []Option{WithBehaviour(Behaviour{})},
+			Query:              "?id=3",
+			ExpectedStatus:     http.StatusOK,
+			ExpectedRepository: &models.Repository{ID: 3, Name: "yellow"},
+		},
+		{
+			Name:           "unknown repository",
+			Options:        []Option{WithBehaviour(Behaviour{})},
+			Query:          "?id=11",
+			ExpectedStatus: http.StatusNotFound,
+		},
+		{
+			Name:           "error ratio",
+			Options:        []Option{WithBehaviour(Behaviour{})},
+			Query:          "?errorRatio=1",
+			ExpectedStatus: http.StatusInternalServerError,
+		},
+		{
+			Name:           "too many requests ratio",
+			Options:        []Option{WithBehaviour(Behaviour{})},
+			Query:          "?tooManyRequestsRatio=1",
+			ExpectedStatus: http.StatusTooManyRequests,
+		},
+		{
+			Name:           "unavailable ratio",
+			Options:        []Option{WithBehaviour(Behaviour{})},
+			Query:          "?unavailableRatio=1",
+			ExpectedStatus: http.StatusServiceUnavailable,
+		},
+		{
+			Name:            "truncate ratio",
+			Options:         []Option{WithBehaviour(Behaviour{})},
+			Query:           "?truncateRatio=1",
+			ExpectedStatus:  http.StatusOK,
+			ExpectedInvalid: true,
+		},
+		{
+			Name:               "redirect ratio",
+			Options:            []Option{WithBehaviour(Behaviour{})},
+			Query:              "?id=3&redirectRatio=1",
+			ExpectedStatus:     http.StatusOK,
+			ExpectedRepository: &models.Repository{ID: 3, Name: "yellow"},
+			ExpectedCalls:      2,
+		},
+	} {
+		t.Run(testCase.Name, func(t *testing.T) {
+			var (
+				host       = New(testCase.Options...)
+				testServer = httptest.NewServer(host)
+			)
+
+			defer testServer.Close()
+
+			resp, err := http.Get(testServer.URL + "/repository" + testCase.Query)
+			if testCase.ExpectedDropped {
+				require.NotNil(t, err)
+				host.AssertCalls(t, 1)
+				return
+			}
+
+			require.Nil(t, err)
+
+			defer resp.Body.Close()
+
+			assert.Equal(t, testCase.ExpectedStatus, resp.StatusCode)
+
+			if testCase.ExpectedInvalid {
+				var body interface{}
+				assert.NotNil(t, json.NewDecoder(resp.Body).Decode(&body))
+			}
+
+			if testCase.ExpectedRepository != nil {
+				var body struct {
+					Repository models.Repository `json:"repository"`
+				}
+
+				require.Nil(t, json.NewDecoder(resp.Body).Decode(&body))
+
+				if testCase.ExpectedRepository.FetchedAt.IsZero() {
+					// unscripted repositories are fetched now
+					assert.False(t, body.Repository.FetchedAt.IsZero())
+					body.Repository.FetchedAt = time.Time{}
+				}
+
+				assert.Equal(t, *testCase.ExpectedRepository, body.Repository)
+			}
+
+			if testCase.ExpectedCalls == 0 {
+				testCase.ExpectedCalls = 1
+			}
+
+			host.AssertCalls(t, testCase.ExpectedCalls)
+			host.AssertExhausted(t)
+		})
+	}
+}
+
+func TestFailureModes(t *testing.T) {
+	for _, testCase := range []struct {
+		Name  string
+		Query string
+		// expectations
+		ExpectedFailure     string
+		ExpectedTimeout     bool
+		ExpectedContentType string
+		ExpectedMinDuration time.Duration
+		ExpectedMinLength   int
+	}{
+		{
+			Name:                "slow body",
+			Query:               "?id=3&slowBodyRatio=1",
+			ExpectedFailure:     "slowBody",
+			ExpectedContentType: "application/json",
+			ExpectedMinDuration: 20 * slowBodyDelay,
+		},
+		{
+			Name:                "wrong content type",
+			Query:               "?id=3&wrongContentTypeRatio=1",
+			ExpectedFailure:     "wrongContentType",
+			ExpectedContentType: "text/html",
+		},
+		{
+			Name:                "oversize",
+			Query:               "?id=3&oversizeRatio=1",
+			ExpectedFailure:     "oversize",
+			ExpectedContentType: "application/json",
+			ExpectedMinLength:   oversizeBytes,
+		},
+		{
+			Name:            "stall",
+			Query:           "?id=3&stallRatio=1",
+			ExpectedFailure: "stall",
+			ExpectedTimeout: true,
+		},
+	} {
+		t.Run(testCase.Name, func(t *testing.T) {
+			var (
+				host       = New(WithBehaviour(Behaviour{}))
+				testServer = httptest.NewServer(host)
+				client     = &http.Client{Timeout: 5 * time.Second}
+			)
+
+			defer testServer.Close()
+
+			if testCase.ExpectedTimeout {
+				client.Timeout = 100 * time.Millisecond
+			}
+
+			start := time.Now()
+
+			resp, err := client.Get(testServer.URL + "/repository" + testCase.Query)
+			if testCase.ExpectedTimeout {
+				require.NotNil(t, err)
+				assert.Equal(t, map[string]int{testCase.ExpectedFailure: 1}, host.Stats().Failures)
+				return
+			}
+
+			require.Nil(t, err)
+
+			defer resp.Body.Close()
+
+			data, err := ioutil.ReadAll(resp.Body)
+			require.Nil(t, err)
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, testCase.ExpectedContentType, resp.Header.Get("Content-Type"))
+			assert.True(t, time.Since(start) >= testCase.ExpectedMinDuration)
+			assert.True(t, len(data) >= testCase.ExpectedMinLength)
+
+			// the body is still a valid repository
+			var body struct {
+				Repository models.Repository `json:"repository"`
+			}
+
+			require.Nil(t, json.Unmarshal(data, &body))
+			assert.Equal(t, "yellow", body.Repository.Name)
+
+			assert.Equal(t, map[string]int{testCase.ExpectedFailure: 1}, host.Stats().Failures)
+		})
+	}
+}
+
+func TestSeed(t *testing.T) {
+	sequence := func(query string, opts ...Option) (ids []int, statuses []int) {
+		testServer := httptest.NewServer(New(opts...))
+		defer testServer.Close()
+
+		for i := 0; i < 10; i++ {
+			resp, err := http.Get(testServer.URL + "/repository?latency=0s&errorRatio=0.5" + query)
+			require.Nil(t, err)
+
+			var body struct {
+				Repository models.Repository `json:"repository"`
+			}
+
+			json.NewDecoder(resp.Body).Decode(&body)
+			resp.Body.Close()
+
+			ids = append(ids, body.Repository.ID)
+			statuses = append(statuses, resp.StatusCode)
+		}
+
+		return
+	}
+
+	t.Run("server seed", func(t *testing.T) {
+		ids, statuses := sequence("", WithSeed(42))
+		expectedIDs, expectedStatuses := sequence("", WithSeed(42))
+
+		assert.Equal(t, expectedIDs, ids)
+		assert.Equal(t, expectedStatuses, statuses)
+	})
+
+	t.Run("server seed zero", func(t *testing.T) {
+		ids, _ := sequence("", WithSeed(0))
+		expectedIDs, _ := sequence("", WithSeed(0))
+
+		assert.Equal(t, expectedIDs, ids)
+	})
+
+	t.Run("request seed", func(t *testing.T) {
+		ids, statuses := sequence("&seed=7")
+		expectedIDs, expectedStatuses := sequence("&seed=7")
+
+		assert.Equal(t, expectedIDs, ids)
+		assert.Equal(t, expectedStatuses, statuses)
+
+		// calls forwarded with the same seed are not all alike
+		var distinct bool
+		for i := range ids {
+			distinct = distinct || ids[i] != ids[0]
+		}
+
+		assert.True(t, distinct)
+	})
+
+	t.Run("concurrent calls", func(t *testing.T) {
+		concurrent := func() (outcomes []string) {
+			testServer := httptest.NewServer(New(WithSeed(42)))
+			defer testServer.Close()
+
+			var (
+				mu sync.Mutex
+				wg sync.WaitGroup
+			)
+
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					resp, err := http.Get(testServer.URL + "/repository?latency=0s&errorRatio=0.5")
+					require.Nil(t, err)
+
+					body, _ := ioutil.ReadAll(resp.Body)
+					resp.Body.Close()
+
+					mu.Lock()
+					outcomes = append(outcomes, fmt.Sprintf("%d %s", resp.StatusCode, stripFetchedAt(body)))
+					mu.Unlock()
+				}()
+			}
+
+			wg.Wait()
+
+			sort.Strings(outcomes)
+
+			return
+		}
+
+		// the calls are served in any order but draw the same outcomes
+		assert.Equal(t, concurrent(), concurrent())
+	})
+}
+
+// stripFetchedAt removes the time a repository was fetched from a body.
+func stripFetchedAt(body []byte) string {
+	return regexp.MustCompile(`"fetchedAt":"[^"]*"`).ReplaceAllString(string(body), "")
+}
+
+func TestScenario(t *testing.T) {
+	var (
+		host       = New(WithBehaviour(Behaviour{}))
+		testServer = httptest.NewServer(host)
+		status     = func() int {
+			resp, err := http.Get(testServer.URL + "/repository")
+			require.Nil(t, err)
+			resp.Body.Close()
+
+			return resp.StatusCode
+		}
+	)
+
+	defer testServer.Close()
+
+	assert.Equal(t, http.StatusOK, status())
+
+	resp, err := http.Post(testServer.URL+"/admin/scenario", "application/json", strings.NewReader(`{
+		"phases": [
+			{"name": "outage", "duration": "1h", "behaviour": {"errorRatio": 1}}
+		]
+	}`))
+	require.Nil(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, http.StatusInternalServerError, status())
+
+	host.ResetScenario()
+
+	assert.Equal(t, http.StatusOK, status())
+
+	host.StartScenario(Scenario{Phases: []Phase{
+		{Name: "elapsed", Duration: time.Nanosecond, Behaviour: Behaviour{ErrorRatio: 1}},
+	}})
+
+	// the scenario has completed so the code host has recovered
+	assert.Equal(t, http.StatusOK, status())
+}
+
+func TestParseLatency(t *testing.T) {
+	for _, testCase := range []struct {
+		Spec          string
+		ExpectedMin   time.Duration
+		ExpectedMax   time.Duration
+		ExpectedError bool
+	}{
+		{Spec: "500ms", ExpectedMin: 500 * time.Millisecond, ExpectedMax: 500 * time.Millisecond},
+		{Spec: "uniform(100ms,1s)", ExpectedMin: 100 * time.Millisecond, ExpectedMax: time.Second},
+		{Spec: "normal(500ms,100ms)", ExpectedMin: 0, ExpectedMax: time.Second},
+		{Spec: "exponential(10ms)", ExpectedMin: 0, ExpectedMax: time.Second},
+		{Spec: "pareto(200ms,1.5,2s)", ExpectedMin: 200 * time.Millisecond, ExpectedMax: 2 * time.Second},
+		{Spec: "bimodal(normal(100ms,1ms),2s,0.1)", ExpectedMin: 50 * time.Millisecond, ExpectedMax: 2 * time.Second},
+		{Spec: "normal(500ms)", ExpectedError: true},
+		{Spec: "lognormal(500ms,1)", ExpectedError: true},
+		{Spec: "uniform(1s,100ms)", ExpectedError: true},
+		{Spec: "pareto(200ms,1.5", ExpectedError: true},
+		{Spec: "bimodal(100ms,2s,1.5)", ExpectedError: true},
+		{Spec: "bimodal(100ms,2s,-0.1)", ExpectedError: true},
+		{Spec: "bimodal(100ms,2s,NaN)", ExpectedError: true},
+	} {
+		t.Run(testCase.Spec, func(t *testing.T) {
+			latency, err := ParseLatency(testCase.Spec)
+			if testCase.ExpectedError {
+				require.NotNil(t, err)
+				return
+			}
+
+			require.Nil(t, err)
+			assert.Equal(t, testCase.Spec, latency.String())
+
+			rnd := rand.New(rand.NewSource(1))
+			for i := 0; i < 100; i++ {
+				d := latency.sample(rnd)
+				assert.True(t, d >= testCase.ExpectedMin && d <= testCase.ExpectedMax, "%s out of range", d)
+			}
+		})
+	}
+}
+
+func TestParseToken(t *testing.T) {
+	for _, testCase := range []struct {
+		Name  string
+		Value string
+		// expectations
+		ExpectedToken Token
+		ExpectedError bool
+	}{
+		{
+			Name:          "token",
+			Value:         "abc",
+			ExpectedToken: Token{Value: "abc"},
+		},
+		{
+			Name:          "token with quota",
+			Value:         " abc:10 ",
+			ExpectedToken: Token{Value: "abc", Quota: 10},
+		},
+		{
+			Name:          "token containing colons",
+			Value:         "user:pass:word",
+			ExpectedToken: Token{Value: "user:pass:word"},
+		},
+		{
+			Name:          "token containing colons with quota",
+			Value:         "user:pass:5",
+			ExpectedToken: Token{Value: "user:pass", Quota: 5},
+		},
+		{
+			Name:          "trailing colon",
+			Value:         "abc:",
+			ExpectedToken: Token{Value: "abc:"},
+		},
+		{
+			Name:          "quota out of range",
+			Value:         "abc:99999999999999999999",
+			ExpectedError: true,
+		},
+	} {
+		t.Run(testCase.Name, func(t *testing.T) {
+			token, err := ParseToken(testCase.Value)
+			if testCase.ExpectedError {
+				require.NotNil(t, err)
+				return
+			}
+
+			require.Nil(t, err)
+			assert.Equal(t, testCase.ExpectedToken, token)
+		})
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	var (
+		host       = New(WithBehaviour(Behaviour{}))
+		testServer = httptest.NewServer(host)
+		do         = func(method, path, body string) *http.Response {
+			req, err := http.NewRequest(method, testServer.URL+path, strings.NewReader(body))
+			require.Nil(t, err)
+
+			resp, err := http.DefaultClient.Do(req)
+			require.Nil(t, err)
+			resp.Body.Close()
+
+			return resp
+		}
+	)
+
+	defer testServer.Close()
+
+	assert.Equal(t, http.StatusOK, do(http.MethodPut, "/admin/config", `{"latency": "1ms", "errorRatio": 1}`).StatusCode)
+	assert.Equal(t, "1ms", host.Behaviour().Latency.String())
+	assert.Equal(t, 1.0, host.Behaviour().ErrorRatio)
+
+	assert.Equal(t, http.StatusInternalServerError, do(http.MethodGet, "/repository", "").StatusCode)
+
+	assert.Equal(t, http.StatusOK, do(http.MethodPatch, "/admin/config", `{"errorRatio": 0}`).StatusCode)
+	assert.Equal(t, "1ms", host.Behaviour().Latency.String())
+	assert.Equal(t, 0.0, host.Behaviour().ErrorRatio)
+
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/repository?id=2", "").StatusCode)
+
+	assert.Equal(t, Stats{
+		Calls:    2,
+		Failures: map[string]int{"error": 1},
+		IDs:      map[int]int{2: 1},
+	}, host.Stats())
+}
+
+func TestCatalogue(t *testing.T) {
+	var (
+		repos      = GenerateRepositories(2, []string{"a", "b"})
+		host       = New(WithBehaviour(Behaviour{}), WithRepositories(repos...))
+		testServer = httptest.NewServer(host)
+		do         = func(method, path, body string) int {
+			req, err := http.NewRequest(method, testServer.URL+path, strings.NewReader(body))
+			require.Nil(t, err)
+
+			// the body is JSON however clients label it
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			resp, err := http.DefaultClient.Do(req)
+			require.Nil(t, err)
+			resp.Body.Close()
+
+			return resp.StatusCode
+		}
+	)
+
+	defer testServer.Close()
+
+	assert.Equal(t, http.StatusCreated, do(http.MethodPost, "/repository", `{"name": "c"}`))
+	assert.Equal(t, http.StatusConflict, do(http.MethodPost, "/repository", `{"id": 1, "name": "d"}`))
+	assert.Equal(t, http.StatusOK, do(http.MethodPut, "/repository?id=1", `{"name": "z"}`))
+	assert.Equal(t, http.StatusNotFound, do(http.MethodPut, "/repository?id=4", `{"name": "z"}`))
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/repository?id=2", ""))
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/repository?id=2", ""))
+
+	assert.Equal(t, []models.Repository{{ID: 1, Name: "z"}, {ID: 3, Name: "c"}}, host.Repositories())
+
+	// the catalogue does not alias the repositories it was configured with
+	assert.Equal(t, []models.Repository{{ID: 1, Name: "a"}, {ID: 2, Name: "b"}}, repos)
+
+	// mutations are not calls to the code host API
+	host.AssertCalls(t, 1)
+}
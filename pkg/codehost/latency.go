@@ -0,0 +1,274 @@
+package codehost
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Latency is a distribution from which the latency of each response is
+// sampled. The zero value always samples 0.
+//
+// Latencies are parsed from specs of the following forms:
+//
+//	500ms                     fixed
+//	uniform(100ms,1s)         uniform between min and max
+//	normal(500ms,100ms)       normal with mean and standard deviation
+//	exponential(500ms)        exponential with mean
+//	pareto(200ms,1.5)         pareto with scale and shape
+//	pareto(200ms,1.5,30s)     as above, capped at a maximum
+//	bimodal(100ms,2s,0.1)     the second latency with the given probability
+//	                          and the first otherwise, where each may itself
+//	                          be a spec, e.g. bimodal(normal(100ms,10ms),2s,0.1)
+//
+// Samples are never negative.
+type Latency struct {
+	spec string
+	fn   func(rnd source) time.Duration
+}
+
+// Fixed returns a Latency which always samples d.
+func Fixed(d time.Duration) Latency {
+	return Latency{
+		spec: d.String(),
+		fn:   func(source) time.Duration { return d },
+	}
+}
+
+// ParseLatency parses a latency spec.
+func ParseLatency(spec string) (Latency, error) {
+	spec = strings.TrimSpace(spec)
+
+	open := strings.Index(spec, "(")
+	if open < 0 {
+		d, err := time.ParseDuration(spec)
+		if err != nil {
+			return Latency{}, err
+		}
+
+		return Fixed(d), nil
+	}
+
+	if !strings.HasSuffix(spec, ")") {
+		return Latency{}, fmt.Errorf("latency %q: missing closing parenthesis", spec)
+	}
+
+	var (
+		name   = spec[:open]
+		args   = splitArgs(spec[open+1 : len(spec)-1])
+		sample func(source) time.Duration
+		err    error
+	)
+
+	switch name {
+	case "uniform":
+		sample, err = uniform(args)
+	case "normal":
+		sample, err = normal(args)
+	case "exponential":
+		sample, err = exponential(args)
+	case "pareto":
+		sample, err = pareto(args)
+	case "bimodal":
+		sample, err = bimodal(args)
+	default:
+		err = fmt.Errorf("unknown distribution %q", name)
+	}
+
+	if err != nil {
+		return Latency{}, fmt.Errorf("latency %q: %v", spec, err)
+	}
+
+	return Latency{spec: spec, fn: sample}, nil
+}
+
+// sample returns a latency drawn from the distribution using rnd.
+func (l Latency) sample(rnd source) time.Duration {
+	if l.fn == nil {
+		return 0
+	}
+
+	if d := l.fn(rnd); d > 0 {
+		return d
+	}
+
+	return 0
+}
+
+func (l Latency) String() string {
+	if l.spec == "" {
+		return "0s"
+	}
+
+	return l.spec
+}
+
+func (l Latency) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+func (l *Latency) UnmarshalText(data []byte) (err error) {
+	*l, err = ParseLatency(string(data))
+	return
+}
+
+// splitArgs splits v on the commas which are not nested in parentheses.
+func splitArgs(v string) (args []string) {
+	var depth, start int
+	for i, c := range v {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				args = append(args, strings.TrimSpace(v[start:i]))
+				start = i + 1
+			}
+		}
+	}
+
+	return append(args, strings.TrimSpace(v[start:]))
+}
+
+func parseArgs(args []string, durations int, floats ...*float64) ([]time.Duration, error) {
+	if len(args) != durations+len(floats) {
+		return nil, fmt.Errorf("expected %d arguments, got %d", durations+len(floats), len(args))
+	}
+
+	ds := make([]time.Duration, durations)
+	for i := range ds {
+		d, err := time.ParseDuration(args[i])
+		if err != nil {
+			return nil, err
+		}
+
+		ds[i] = d
+	}
+
+	for i, f := range floats {
+		v, err := strconv.ParseFloat(args[durations+i], 64)
+		if err != nil {
+			return nil, err
+		}
+
+		*f = v
+	}
+
+	return ds, nil
+}
+
+func uniform(args []string) (func(source) time.Duration, error) {
+	ds, err := parseArgs(args, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	min, max := ds[0], ds[1]
+	if max < min {
+		return nil, fmt.Errorf("max %s is less than min %s", max, min)
+	}
+
+	return func(rnd source) time.Duration {
+		return min + time.Duration(rnd.Float64()*float64(max-min))
+	}, nil
+}
+
+func normal(args []string) (func(source) time.Duration, error) {
+	ds, err := parseArgs(args, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	mean, stddev := ds[0], ds[1]
+
+	return func(rnd source) time.Duration {
+		return mean + time.Duration(rnd.NormFloat64()*float64(stddev))
+	}, nil
+}
+
+func exponential(args []string) (func(source) time.Duration, error) {
+	ds, err := parseArgs(args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	mean := ds[0]
+
+	return func(rnd source) time.Duration {
+		return time.Duration(rnd.ExpFloat64() * float64(mean))
+	}, nil
+}
+
+func pareto(args []string) (func(source) time.Duration, error) {
+	var (
+		shape float64
+		max   = time.Duration(math.MaxInt64)
+	)
+
+	if len(args) == 3 {
+		d, err := time.ParseDuration(args[2])
+		if err != nil {
+			return nil, err
+		}
+
+		max, args = d, args[:2]
+	}
+
+	ds, err := parseArgs(args, 1, &shape)
+	if err != nil {
+		return nil, err
+	}
+
+	if shape <= 0 {
+		return nil, fmt.Errorf("shape must be positive")
+	}
+
+	scale := ds[0]
+
+	return func(rnd source) time.Duration {
+		// inverse transform sampling, 1-u is in (0, 1]
+		d := float64(scale) / math.Pow(1-rnd.Float64(), 1/shape)
+		if d >= float64(max) {
+			return max
+		}
+
+		return time.Duration(d)
+	}, nil
+}
+
+func bimodal(args []string) (func(source) time.Duration, error) {
+	if len(args) != 3 {
+		return nil, fmt.Errorf("expected 3 arguments, got %d", len(args))
+	}
+
+	fast, err := ParseLatency(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	slow, err := ParseLatency(args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := strconv.ParseFloat(args[2], 64)
+	if err != nil {
+		return nil, err
+	}
+
+	if !(p >= 0 && p <= 1) {
+		return nil, fmt.Errorf("probability must be between 0 and 1")
+	}
+
+	return func(rnd source) time.Duration {
+		if rnd.Float64() < p {
+			return slow.sample(rnd)
+		}
+
+		return fast.sample(rnd)
+	}, nil
+}
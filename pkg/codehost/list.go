@@ -0,0 +1,190 @@
+package codehost
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/georgemac/repositories/pkg/models"
+)
+
+const (
+	defaultPerPage = 30
+	// MaxPerPage is the maximum number of repositories
+	// listed per page or fetched in a single batch.
+	MaxPerPage = 100
+)
+
+// repositoriesByID returns the repositories identified by the
+// comma separated ids form value, in the order requested.
+func (s *Server) repositoriesByID(r *http.Request) ([]models.Repository, error) {
+	var ids []int
+	for _, v := range strings.Split(r.FormValue("ids"), ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return nil, &httpError{status: http.StatusBadRequest, message: err.Error()}
+		}
+
+		ids = append(ids, id)
+	}
+
+	if len(ids) > MaxPerPage {
+		return nil, &httpError{
+			status:  http.StatusBadRequest,
+			message: fmt.Sprintf("at most %d ids can be fetched at once", MaxPerPage),
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	byID := map[int]models.Repository{}
+	for _, repo := range s.repositories {
+		byID[repo.ID] = repo
+	}
+
+	repos := make([]models.Repository, 0, len(ids))
+	for _, id := range ids {
+		repo, ok := byID[id]
+		if !ok {
+			return nil, &httpError{
+				status:  http.StatusNotFound,
+				message: fmt.Sprintf("repository %d not found", id),
+			}
+		}
+
+		repos = append(repos, repo)
+	}
+
+	return repos, nil
+}
+
+// isBatch returns whether r asks for a batch of repositories, either
+// by ID with the ids form value or at random with the count form value.
+func isBatch(r *http.Request) bool {
+	return r.FormValue("ids") != "" || r.FormValue("count") != ""
+}
+
+// randomRepositories returns count random repositories from the
+// catalogue, as given by the count form value. Like single random
+// repositories they are drawn independently so may repeat.
+func (s *Server) randomRepositories(r *http.Request, rnd source) ([]models.Repository, error) {
+	count, err := intFormValue(r, "count", 1)
+	if err != nil {
+		return nil, err
+	}
+
+	if count < 1 || count > MaxPerPage {
+		return nil, &httpError{
+			status:  http.StatusBadRequest,
+			message: fmt.Sprintf("count must be between 1 and %d", MaxPerPage),
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.repositories) == 0 {
+		return nil, errNotFound
+	}
+
+	repos := make([]models.Repository, 0, count)
+	for i := 0; i < count; i++ {
+		repos = append(repos, s.repositories[rnd.Intn(len(s.repositories))])
+	}
+
+	return repos, nil
+}
+
+// handleListRepositories serves a page of the catalogue.
+func (s *Server) handleListRepositories(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, &httpError{status: http.StatusMethodNotAllowed, message: "method not allowed"})
+		return
+	}
+
+	page, err := intFormValue(r, "page", 1)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	perPage, err := intFormValue(r, "perPage", defaultPerPage)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if page < 1 || perPage < 1 || perPage > MaxPerPage {
+		writeError(w, &httpError{
+			status:  http.StatusBadRequest,
+			message: fmt.Sprintf("page must be positive and perPage between 1 and %d", MaxPerPage),
+		})
+		return
+	}
+
+	rnd, err := s.source(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	catalogue := s.Repositories()
+
+	var (
+		start = (page - 1) * perPage
+		end   = start + perPage
+		repos = []models.Repository{}
+		ids   []int
+	)
+
+	if start < len(catalogue) {
+		if end > len(catalogue) {
+			end = len(catalogue)
+		}
+
+		repos = catalogue[start:end]
+	}
+
+	for i := range repos {
+		repos[i].FetchedAt = time.Now()
+		ids = append(ids, repos[i].ID)
+	}
+
+	b, err := s.currentBehaviour().override(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := b.serve(w, r, rnd, payload{
+		body: map[string]interface{}{
+			"repositories": repos,
+			"page":         page,
+			"perPage":      perPage,
+			"total":        len(catalogue),
+		},
+		ids: ids,
+	}, s); err != nil {
+		writeError(w, err)
+	}
+}
+
+func intFormValue(r *http.Request, key string, def int) (int, error) {
+	v := r.FormValue(key)
+	if v == "" {
+		return def, nil
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, &httpError{
+			status:  http.StatusBadRequest,
+			message: fmt.Sprintf("%s: %v", key, err),
+		}
+	}
+
+	return i, nil
+}
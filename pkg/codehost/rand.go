@@ -0,0 +1,22 @@
+package codehost
+
+// source is the subset of *rand.Rand used to pick
+// repositories, sample latencies and decide whether to misbehave.
+type source interface {
+	Intn(n int) int
+	Float64() float64
+	NormFloat64() float64
+	ExpFloat64() float64
+}
+
+// drawSeed derives the seed of the n-th draw from seed, so that each
+// call has a source of its own which does not depend on the order in
+// which concurrent calls happen to use it.
+func drawSeed(seed, n int64) int64 {
+	// splitmix64
+	z := uint64(seed) + uint64(n+1)*0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+
+	return int64(z ^ (z >> 31))
+}
@@ -0,0 +1,223 @@
+package codehost
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Scenario describes how the behaviour of the code host changes over
+// time, e.g. healthy for 30s, failing for 10s and then slow for 20s.
+// Once every phase has elapsed the code host recovers, returning to its
+// configured behaviour, unless the scenario loops.
+type Scenario struct {
+	Phases []Phase `json:"phases"`
+	Loop   bool    `json:"loop,omitempty"`
+}
+
+// Phase is a period of a Scenario during which the
+// code host behaves according to Behaviour.
+type Phase struct {
+	Name      string
+	Duration  time.Duration
+	Behaviour Behaviour
+}
+
+type phaseJSON struct {
+	Name      string    `json:"name,omitempty"`
+	Duration  string    `json:"duration"`
+	Behaviour Behaviour `json:"behaviour"`
+}
+
+func (p Phase) MarshalJSON() ([]byte, error) {
+	return json.Marshal(phaseJSON{
+		Name:      p.Name,
+		Duration:  p.Duration.String(),
+		Behaviour: p.Behaviour,
+	})
+}
+
+func (p *Phase) UnmarshalJSON(data []byte) error {
+	var v phaseJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	d, err := time.ParseDuration(v.Duration)
+	if err != nil {
+		return err
+	}
+
+	*p = Phase{Name: v.Name, Duration: d, Behaviour: v.Behaviour}
+
+	return nil
+}
+
+// LoadScenario reads a JSON encoded Scenario from path.
+func LoadScenario(path string) (Scenario, error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return Scenario{}, err
+	}
+
+	defer fi.Close()
+
+	return decodeScenario(fi)
+}
+
+func decodeScenario(r io.Reader) (sc Scenario, err error) {
+	if err = json.NewDecoder(r).Decode(&sc); err != nil {
+		return
+	}
+
+	err = sc.validate()
+
+	return
+}
+
+func (sc Scenario) validate() error {
+	for _, phase := range sc.Phases {
+		if phase.Duration <= 0 {
+			return errors.New("scenario phases must have a positive duration")
+		}
+	}
+
+	return nil
+}
+
+func (sc Scenario) duration() (d time.Duration) {
+	for _, phase := range sc.Phases {
+		d += phase.Duration
+	}
+
+	return
+}
+
+// phase returns the phase active once elapsed has passed
+// since the scenario started, if any.
+func (sc Scenario) phase(elapsed time.Duration) (Phase, bool) {
+	total := sc.duration()
+	if total == 0 {
+		return Phase{}, false
+	}
+
+	if sc.Loop {
+		elapsed %= total
+	}
+
+	for _, phase := range sc.Phases {
+		if elapsed < phase.Duration {
+			return phase, true
+		}
+
+		elapsed -= phase.Duration
+	}
+
+	return Phase{}, false
+}
+
+// WithScenario configures a scenario which starts when the server is created.
+func WithScenario(sc Scenario) Option {
+	return func(s *Server) {
+		s.scenario = &sc
+		s.started = time.Now()
+	}
+}
+
+// StartScenario starts sc from its first phase,
+// replacing any scenario already running.
+func (s *Server) StartScenario(sc Scenario) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.scenario = &sc
+	s.started = time.Now()
+}
+
+// ResetScenario stops the running scenario, returning
+// the code host to its configured behaviour.
+func (s *Server) ResetScenario() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.started = time.Time{}
+}
+
+// currentBehaviour returns the behaviour of the active
+// scenario phase, falling back to the configured behaviour.
+func (s *Server) currentBehaviour() Behaviour {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.scenario == nil || s.started.IsZero() {
+		return s.behaviour
+	}
+
+	if phase, ok := s.scenario.phase(time.Since(s.started)); ok {
+		return phase.Behaviour
+	}
+
+	return s.behaviour
+}
+
+type scenarioStatus struct {
+	Scenario *Scenario `json:"scenario"`
+	Running  bool      `json:"running"`
+	Elapsed  string    `json:"elapsed,omitempty"`
+	Phase    *Phase    `json:"phase,omitempty"`
+}
+
+// handleScenario reports the scenario on GET, starts it from the first
+// phase on POST (loading the scenario from the body if one is given)
+// and stops it on DELETE.
+func (s *Server) handleScenario(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if r.ContentLength != 0 {
+			sc, err := decodeScenario(r.Body)
+			if err != nil {
+				writeError(w, &httpError{status: http.StatusBadRequest, message: err.Error()})
+				return
+			}
+
+			s.StartScenario(sc)
+			break
+		}
+
+		s.mu.Lock()
+		sc := s.scenario
+		s.mu.Unlock()
+
+		if sc == nil {
+			writeError(w, &httpError{status: http.StatusConflict, message: "no scenario loaded"})
+			return
+		}
+
+		s.StartScenario(*sc)
+	case http.MethodDelete:
+		s.ResetScenario()
+	default:
+		writeError(w, &httpError{status: http.StatusMethodNotAllowed, message: "method not allowed"})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := scenarioStatus{Scenario: s.scenario}
+	if s.scenario != nil && !s.started.IsZero() {
+		elapsed := time.Since(s.started)
+
+		status.Elapsed = elapsed.String()
+		if phase, ok := s.scenario.phase(elapsed); ok {
+			status.Running = true
+			status.Phase = &phase
+		}
+	}
+
+	writeJSON(w, status)
+}
@@ -0,0 +1,136 @@
+package codehost
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/georgemac/repositories/pkg/models"
+)
+
+type outcome int
+
+const (
+	outcomeDefault outcome = iota
+	outcomeRepository
+	outcomeError
+	outcomeDrop
+	outcomeGarbage
+)
+
+// Response is a scripted response to a single call to /repository.
+type Response struct {
+	outcome    outcome
+	repository models.Repository
+	status     int
+	latency    time.Duration
+}
+
+// Default serves the call as if it were not scripted.
+func Default() Response {
+	return Response{outcome: outcomeDefault}
+}
+
+// Respond serves repo exactly as given, as a batch of one
+// repository when the call asks for a batch.
+func Respond(repo models.Repository) Response {
+	return Response{outcome: outcomeRepository, repository: repo}
+}
+
+// Fail responds with an error and the given status code.
+func Fail(status int) Response {
+	return Response{outcome: outcomeError, status: status}
+}
+
+// Drop closes the connection without responding.
+func Drop() Response {
+	return Response{outcome: outcomeDrop}
+}
+
+// Garbage responds with a body which is not valid JSON.
+func Garbage() Response {
+	return Response{outcome: outcomeGarbage}
+}
+
+// After delays the response by d.
+func (resp Response) After(d time.Duration) Response {
+	resp.latency = d
+	return resp
+}
+
+func (resp Response) serve(w http.ResponseWriter, r *http.Request, rec recorder) {
+	time.Sleep(resp.latency)
+
+	switch resp.outcome {
+	case outcomeRepository:
+		rec.servedID(resp.repository.ID)
+
+		if isBatch(r) {
+			// a batch of one, which leaves the rest of the batch to later calls
+			writeJSON(w, map[string]interface{}{
+				"repositories": []models.Repository{resp.repository},
+			})
+			return
+		}
+
+		writeRepository(w, resp.repository)
+	case outcomeError:
+		rec.injected("error")
+		writeError(w, &httpError{
+			status:  resp.status,
+			message: "scripted error!",
+		})
+	case outcomeDrop:
+		rec.injected("drop")
+		// aborts the connection without logging a stack trace
+		panic(http.ErrAbortHandler)
+	case outcomeGarbage:
+		rec.injected("garbage")
+		w.Write([]byte("random garbage!"))
+	}
+}
+
+// TestingT is the subset of testing.TB used to report failed assertions.
+type TestingT interface {
+	Errorf(format string, args ...interface{})
+}
+
+// Calls returns the number of calls made to /repository.
+func (s *Server) Calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls
+}
+
+// AssertCalls reports an error to t unless exactly expected
+// calls have been made to /repository.
+func (s *Server) AssertCalls(t TestingT, expected int) bool {
+	if h, ok := t.(interface{ Helper() }); ok {
+		h.Helper()
+	}
+
+	if calls := s.Calls(); calls != expected {
+		t.Errorf("expected %d calls to code host, got %d", expected, calls)
+		return false
+	}
+
+	return true
+}
+
+// AssertExhausted reports an error to t unless every
+// scripted response has been served.
+func (s *Server) AssertExhausted(t TestingT) bool {
+	if h, ok := t.(interface{ Helper() }); ok {
+		h.Helper()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.calls < len(s.script) {
+		t.Errorf("expected %d scripted calls to code host, got %d", len(s.script), s.calls)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,649 @@
+// Package config loads the configuration of the repositories proxy from,
+// in increasing order of precedence, defaults, a JSON file, environment
+// variables and command line flags.
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/georgemac/repositories/pkg/graceful"
+	"github.com/georgemac/repositories/pkg/logging"
+	"github.com/georgemac/repositories/pkg/repositories"
+)
+
+const (
+	// EnvPrefix prefixes the environment variable of every setting,
+	// e.g. REPOSITORIES_ADDR for -addr.
+	EnvPrefix = "REPOSITORIES_"
+	// FileEnv names the config file when -config is not given.
+	FileEnv = EnvPrefix + "CONFIG"
+
+	redacted = "[redacted]"
+)
+
+// Config is the configuration of cmd/repositories.
+type Config struct {
+	// Addr is the address on which the proxy is served.
+	Addr string `json:"addr"`
+	// DrainTimeout is how long requests in flight are given to complete on shutdown.
+	DrainTimeout Duration `json:"drainTimeout"`
+	// AdminToken is the bearer token required by the admin
+	// endpoints, which are not served when it is empty.
+	AdminToken string `json:"adminToken,omitempty"`
+	// LogFormat is json or logfmt and LogLevel one of debug,
+	// info, warn or error. Debug logs every upstream call.
+	LogFormat string   `json:"logFormat"`
+	LogLevel  string   `json:"logLevel"`
+	TLS       TLS      `json:"tls"`
+	Auth      Auth     `json:"auth"`
+	Upstream  Upstream `json:"upstream"`
+	Server    Server   `json:"server"`
+
+	// digests of the files named by file settings when loaded
+	digests map[string]string
+}
+
+// TLS configures serving the proxy over TLS, which it is when a
+// certificate is given. The certificate is reloaded when it changes.
+type TLS struct {
+	CertFile       string   `json:"certFile,omitempty"`
+	KeyFile        string   `json:"keyFile,omitempty"`
+	ReloadInterval Duration `json:"reloadInterval"`
+}
+
+// Auth configures how clients of /repositories are authenticated, which
+// they are when API keys or a key to verify JSON Web Tokens is given.
+type Auth struct {
+	APIKeysFile      string   `json:"apiKeysFile,omitempty"`
+	JWTSecretFile    string   `json:"jwtSecretFile,omitempty"`
+	JWTPublicKeyFile string   `json:"jwtPublicKeyFile,omitempty"`
+	JWTIssuer        string   `json:"jwtIssuer,omitempty"`
+	JWTAudience      string   `json:"jwtAudience,omitempty"`
+	JWTLeeway        Duration `json:"jwtLeeway"`
+}
+
+// Enabled reports whether clients must authenticate.
+func (a Auth) Enabled() bool {
+	return a.APIKeysFile != "" || a.JWT()
+}
+
+// JWT reports whether JSON Web Tokens are accepted.
+func (a Auth) JWT() bool {
+	return a.JWTSecretFile != "" || a.JWTPublicKeyFile != ""
+}
+
+// Upstream configures how repositories.Service calls the repository service.
+type Upstream struct {
+	Addresses         []string `json:"addresses,omitempty"`
+	AddressesFile     string   `json:"addressesFile,omitempty"`
+	AddressesInterval Duration `json:"addressesInterval"`
+	TokensFile        string   `json:"tokensFile,omitempty"`
+	CAFile            string   `json:"caFile,omitempty"`
+	CertFile          string   `json:"certFile,omitempty"`
+	KeyFile           string   `json:"keyFile,omitempty"`
+	ProfilesFile      string   `json:"profilesFile,omitempty"`
+	Profile           string   `json:"profile"`
+	Balancing         string   `json:"balancing"`
+	MaxAttempts       int      `json:"maxAttempts"`
+	EjectAfter        int      `json:"ejectAfter"`
+	EjectFor          Duration `json:"ejectFor"`
+}
+
+// Server configures how server.Server handles requests.
+type Server struct {
+	// UpstreamParamsToken is presented by clients permitted to pass
+	// upstream.* parameters through. They are forbidden when empty.
+	UpstreamParamsToken string `json:"upstreamParamsToken,omitempty"`
+	// MaxCount limits the repositories requested, unless it is zero.
+	MaxCount int `json:"maxCount"`
+}
+
+// Default returns the configuration used for settings which are not set.
+func Default() Config {
+	return Config{
+		Addr:         ":8080",
+		DrainTimeout: Duration(graceful.DefaultDrainTimeout),
+		LogFormat:    string(logging.Logfmt),
+		LogLevel:     "info",
+		TLS:          TLS{ReloadInterval: Duration(time.Minute)},
+		Upstream: Upstream{
+			Addresses:         []string{"http://localhost:7080"},
+			AddressesInterval: Duration(5 * time.Second),
+			Profile:           repositories.DefaultProfile,
+			Balancing:         string(repositories.RoundRobin),
+			EjectAfter:        repositories.DefaultEjectAfter,
+			EjectFor:          Duration(repositories.DefaultEjectFor),
+		},
+	}
+}
+
+// setting is a single configurable value, set from a flag of the same
+// name or an environment variable named after it.
+type setting struct {
+	name  string
+	usage string
+	value func(*Config) flag.Value
+	// secret settings are redacted when printed
+	secret bool
+	// restart settings only take effect on restart
+	restart bool
+	// file settings name a file which is read again on reload
+	file bool
+}
+
+func (s setting) env() string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(s.name, "-", "_", -1))
+}
+
+var settings = []setting{
+	{
+		name:    "addr",
+		usage:   "address on which to serve the repositories service",
+		value:   func(c *Config) flag.Value { return (*stringValue)(&c.Addr) },
+		restart: true,
+	},
+	{
+		name:    "drain-timeout",
+		usage:   "how long requests in flight are given to complete on shutdown before they are cancelled",
+		value:   func(c *Config) flag.Value { return &c.DrainTimeout },
+		restart: true,
+	},
+	{
+		name:    "tls-cert",
+		usage:   "path to the PEM certificate used to serve over TLS",
+		value:   func(c *Config) flag.Value { return (*stringValue)(&c.TLS.CertFile) },
+		restart: true,
+	},
+	{
+		name:    "tls-key",
+		usage:   "path to the PEM key of -tls-cert",
+		value:   func(c *Config) flag.Value { return (*stringValue)(&c.TLS.KeyFile) },
+		restart: true,
+	},
+	{
+		name:    "tls-reload-interval",
+		usage:   "how often -tls-cert and -tls-key are checked for changes",
+		value:   func(c *Config) flag.Value { return &c.TLS.ReloadInterval },
+		restart: true,
+	},
+	{
+		name:  "api-keys-file",
+		usage: "path to a JSON array of API keys with the name and limits of each principal, e.g. [{\"key\": \"...\", \"name\": \"ci\", \"limits\": {\"maxCount\": 10}}]",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.Auth.APIKeysFile) },
+		file:  true,
+	},
+	{
+		name:  "jwt-secret-file",
+		usage: "path to the secret verifying HS256 JSON Web Tokens",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.Auth.JWTSecretFile) },
+		file:  true,
+	},
+	{
+		name:  "jwt-public-key-file",
+		usage: "path to the PEM RSA public key verifying RS256 JSON Web Tokens",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.Auth.JWTPublicKeyFile) },
+		file:  true,
+	},
+	{
+		name:  "jwt-issuer",
+		usage: "issuer required of JSON Web Tokens (default any)",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.Auth.JWTIssuer) },
+	},
+	{
+		name:  "jwt-audience",
+		usage: "audience required of JSON Web Tokens (default any)",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.Auth.JWTAudience) },
+	},
+	{
+		name:  "jwt-leeway",
+		usage: "allowance for clock skew when checking the expiry of JSON Web Tokens",
+		value: func(c *Config) flag.Value { return &c.Auth.JWTLeeway },
+	},
+	{
+		name:  "repository-addr",
+		usage: "comma separated addresses on which repository service is found",
+		value: func(c *Config) flag.Value { return (*addressesValue)(&c.Upstream.Addresses) },
+	},
+	{
+		name:  "repository-addr-file",
+		usage: "path to a file of repository service addresses, one per line or a JSON array, which is watched for changes (overrides -repository-addr)",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.Upstream.AddressesFile) },
+		file:  true,
+	},
+	{
+		name:  "repository-addr-interval",
+		usage: "how often -repository-addr-file is checked for changes",
+		value: func(c *Config) flag.Value { return &c.Upstream.AddressesInterval },
+	},
+	{
+		name:  "repository-tokens-file",
+		usage: "path to a file of bearer tokens for the repository service, one per line, ignoring blank lines and # comments (default $" + repositories.TokensEnv + ")",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.Upstream.TokensFile) },
+		file:  true,
+	},
+	{
+		name:  "repository-ca",
+		usage: "path to a PEM bundle of CA certificates trusted for https repository services (default system roots)",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.Upstream.CAFile) },
+		file:  true,
+	},
+	{
+		name:  "repository-cert",
+		usage: "path to a PEM client certificate presented to repository services",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.Upstream.CertFile) },
+		file:  true,
+	},
+	{
+		name:  "repository-key",
+		usage: "path to the PEM key of -repository-cert",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.Upstream.KeyFile) },
+		file:  true,
+	},
+	{
+		name:  "profiles",
+		usage: "path to a JSON file of named upstream profiles (path, query and headers)",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.Upstream.ProfilesFile) },
+		file:  true,
+	},
+	{
+		name:  "profile",
+		usage: "name of the upstream profile used when a request does not select one",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.Upstream.Profile) },
+	},
+	{
+		name:  "balancing",
+		usage: "how calls are spread across repository services: round-robin, least-outstanding or latency-weighted",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.Upstream.Balancing) },
+	},
+	{
+		name:  "max-attempts",
+		usage: "maximum repository services a failed call is attempted against (0 attempts every repository service once)",
+		value: func(c *Config) flag.Value { return (*intValue)(&c.Upstream.MaxAttempts) },
+	},
+	{
+		name:  "eject-after",
+		usage: "consecutive failures after which a repository service is ejected (0 disables ejection)",
+		value: func(c *Config) flag.Value { return (*intValue)(&c.Upstream.EjectAfter) },
+	},
+	{
+		name:  "eject-for",
+		usage: "how long an ejected repository service is avoided",
+		value: func(c *Config) flag.Value { return &c.Upstream.EjectFor },
+	},
+	{
+		name:  "max-count",
+		usage: "maximum number of repositories a request may ask for (0 is unlimited)",
+		value: func(c *Config) flag.Value { return (*intValue)(&c.Server.MaxCount) },
+	},
+	{
+		name:    "log-format",
+		usage:   "format of log records: json or logfmt",
+		value:   func(c *Config) flag.Value { return (*stringValue)(&c.LogFormat) },
+		restart: true,
+	},
+	{
+		name:  "log-level",
+		usage: "minimum level of log records: debug, info, warn or error",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.LogLevel) },
+	},
+	{
+		name:    "admin-token",
+		usage:   "bearer token required by the admin endpoints, which are disabled when empty",
+		value:   func(c *Config) flag.Value { return (*stringValue)(&c.AdminToken) },
+		secret:  true,
+		restart: true,
+	},
+	{
+		name:   "upstream-params-token",
+		usage:  "token which clients present in the X-Upstream-Token header to pass upstream.* parameters through (disabled when empty)",
+		value:  func(c *Config) flag.Value { return (*stringValue)(&c.Server.UpstreamParamsToken) },
+		secret: true,
+	},
+}
+
+// Flags holds the command line flags of the configuration.
+type Flags struct {
+	set   *flag.FlagSet
+	flags Config
+
+	// File is the path of the config file.
+	File string
+	// Print requests the effective configuration is printed.
+	Print bool
+}
+
+// NewFlags registers a flag for every setting on fs, along
+// with -config naming a file and -print-config.
+func NewFlags(fs *flag.FlagSet) *Flags {
+	f := &Flags{set: fs, flags: Default()}
+
+	fs.StringVar(&f.File, "config", "", "path to a JSON config file (default $"+FileEnv+")")
+	fs.BoolVar(&f.Print, "print-config", false, "print the effective configuration and exit")
+
+	for _, s := range settings {
+		fs.Var(s.value(&f.flags), s.name, s.usage+" ($"+s.env()+")")
+	}
+
+	return f
+}
+
+// Load builds the configuration from the defaults, the config file, the
+// environment looked up with getenv and the flags which were set, then
+// validates it. It must be called once the flags have been parsed.
+func (f *Flags) Load(getenv func(string) string) (Config, error) {
+	cfg := Default()
+
+	path := f.File
+	if path == "" {
+		path = getenv(FileEnv)
+	}
+
+	if path != "" {
+		if err := loadFile(path, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+
+	for _, s := range settings {
+		if v := getenv(s.env()); v != "" {
+			if err := s.value(&cfg).Set(v); err != nil {
+				return cfg, fmt.Errorf("$%s: %v", s.env(), err)
+			}
+		}
+	}
+
+	var err error
+	f.set.Visit(func(fl *flag.Flag) {
+		for _, s := range settings {
+			if s.name == fl.Name && err == nil {
+				err = s.value(&cfg).Set(fl.Value.String())
+			}
+		}
+	})
+
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.digests = digestFiles(cfg)
+
+	return cfg, cfg.Validate()
+}
+
+// digestFiles returns the digests of the files named by the file
+// settings of cfg, keyed by setting. Files which cannot be read are
+// left out, to be reported when the configuration is applied.
+func digestFiles(cfg Config) (digests map[string]string) {
+	for _, s := range settings {
+		path := s.value(&cfg).String()
+		if !s.file || path == "" {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		if digests == nil {
+			digests = map[string]string{}
+		}
+
+		sum := sha256.Sum256(data)
+		digests[s.name] = hex.EncodeToString(sum[:])
+	}
+
+	return
+}
+
+func loadFile(path string, cfg *Config) error {
+	fi, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer fi.Close()
+
+	dec := json.NewDecoder(fi)
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	return nil
+}
+
+// Validate reports the first setting of c which is invalid.
+func (c Config) Validate() error {
+	if c.Addr == "" {
+		return errors.New("addr must be set")
+	}
+
+	if len(c.Upstream.Addresses) == 0 && c.Upstream.AddressesFile == "" {
+		return errors.New("repository-addr or repository-addr-file must be set")
+	}
+
+	for _, address := range c.Upstream.Addresses {
+		u, err := url.Parse(address)
+		if err != nil {
+			return fmt.Errorf("repository-addr: %v", err)
+		}
+
+		if u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("repository-addr: %q must be an absolute URL", address)
+		}
+	}
+
+	if _, err := logging.ParseFormat(c.LogFormat); err != nil {
+		return fmt.Errorf("log-format: %v", err)
+	}
+
+	if _, err := logging.ParseLevel(c.LogLevel); err != nil {
+		return fmt.Errorf("log-level: %v", err)
+	}
+
+	if _, err := repositories.ParseBalancing(c.Upstream.Balancing); err != nil {
+		return fmt.Errorf("balancing: %v", err)
+	}
+
+	switch {
+	case (c.TLS.CertFile == "") != (c.TLS.KeyFile == ""):
+		return errors.New("tls-cert and tls-key must be set together")
+	case c.TLS.CertFile != "" && c.TLS.ReloadInterval <= 0:
+		return errors.New("tls-reload-interval must be positive")
+	case (c.Upstream.CertFile == "") != (c.Upstream.KeyFile == ""):
+		return errors.New("repository-cert and repository-key must be set together")
+	case (c.Auth.JWTIssuer != "" || c.Auth.JWTAudience != "") && !c.Auth.JWT():
+		return errors.New("jwt-issuer and jwt-audience require jwt-secret-file or jwt-public-key-file")
+	case c.Auth.JWTLeeway < 0:
+		return errors.New("jwt-leeway must not be negative")
+	case c.DrainTimeout < 0:
+		return errors.New("drain-timeout must not be negative")
+	case c.Upstream.AddressesFile != "" && c.Upstream.AddressesInterval <= 0:
+		return errors.New("repository-addr-interval must be positive")
+	case c.Upstream.MaxAttempts < 0:
+		return errors.New("max-attempts must not be negative")
+	case c.Upstream.EjectAfter < 0:
+		return errors.New("eject-after must not be negative")
+	case c.Upstream.EjectAfter > 0 && c.Upstream.EjectFor <= 0:
+		return errors.New("eject-for must be positive when ejection is enabled")
+	}
+
+	return nil
+}
+
+// Print writes c to w as indented JSON with secrets redacted.
+func (c Config) Print(w io.Writer) error {
+	for _, s := range settings {
+		if v := s.value(&c); s.secret && v.String() != "" {
+			v.Set(redacted)
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(c)
+}
+
+// Change is a setting which differs between two configurations.
+type Change struct {
+	Setting string `json:"setting"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+	// Restart is set when the change only takes effect on restart.
+	Restart bool `json:"restart,omitempty"`
+	// Reloaded is set when the setting names the same file
+	// but its contents changed.
+	Reloaded bool `json:"reloaded,omitempty"`
+}
+
+func (c Change) String() string {
+	s := fmt.Sprintf("%s: %q -> %q", c.Setting, c.From, c.To)
+	if c.Reloaded {
+		s += " (contents changed)"
+	}
+
+	if c.Restart {
+		s += " (requires restart)"
+	}
+
+	return s
+}
+
+// Diff returns the settings which differ between from and to, in the
+// order they are documented, including files named by both whose
+// contents changed between loading from and to. The values of secrets
+// are redacted.
+func Diff(from, to Config) (changes []Change) {
+	for _, s := range settings {
+		change := Change{
+			Setting: s.name,
+			From:    s.value(&from).String(),
+			To:      s.value(&to).String(),
+			Restart: s.restart,
+		}
+
+		if change.From == change.To {
+			if !s.file || from.digests[s.name] == to.digests[s.name] {
+				continue
+			}
+
+			change.Reloaded = true
+		}
+
+		if s.secret {
+			change.From, change.To = redact(change.From), redact(change.To)
+		}
+
+		changes = append(changes, change)
+	}
+
+	return
+}
+
+// KeepRestart returns c with the settings which only take effect on
+// restart set as they are in running, the configuration the process
+// was started with, so that c describes the configuration in effect.
+func (c Config) KeepRestart(running Config) Config {
+	for _, s := range settings {
+		if s.restart {
+			// the value was valid in running so is valid in c
+			s.value(&c).Set(s.value(&running).String())
+		}
+	}
+
+	return c
+}
+
+func redact(v string) string {
+	if v == "" {
+		return v
+	}
+
+	return redacted
+}
+
+// Duration is a time.Duration encoded as a string such as "1m30s".
+type Duration time.Duration
+
+func (d Duration) String() string { return time.Duration(d).String() }
+
+func (d *Duration) Set(v string) error {
+	parsed, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	return d.Set(string(text))
+}
+
+type stringValue string
+
+func (s *stringValue) String() string     { return string(*s) }
+func (s *stringValue) Set(v string) error { *s = stringValue(v); return nil }
+
+type intValue int
+
+func (i *intValue) String() string { return strconv.Itoa(int(*i)) }
+
+func (i *intValue) Set(v string) error {
+	parsed, err := strconv.Atoi(v)
+	if err != nil {
+		return err
+	}
+
+	*i = intValue(parsed)
+
+	return nil
+}
+
+// addressesValue is a comma separated list of absolute URLs. Only a
+// comma followed by a scheme starts a new address, so that queries
+// such as latency=normal(500ms,100ms) are kept whole.
+type addressesValue []string
+
+// addressStart matches the comma before each address but the first.
+var addressStart = regexp.MustCompile(`,\s*[a-zA-Z][a-zA-Z0-9+.-]*://`)
+
+func (l *addressesValue) String() string { return strings.Join(*l, ",") }
+
+func (l *addressesValue) Set(v string) error {
+	*l = nil
+
+	var start int
+	for _, match := range append(addressStart.FindAllStringIndex(v, -1), []int{len(v), len(v)}) {
+		if item := strings.TrimSpace(v[start:match[0]]); item != "" {
+			*l = append(*l, item)
+		}
+
+		// the address starts after the comma
+		start = match[0] + 1
+	}
+
+	return nil
+}
@@ -0,0 +1,199 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	require.Nil(t, err)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	require.Nil(t, ioutil.WriteFile(path, []byte(`{
+		"addr": ":9090",
+		"upstream": {"addresses": ["http://file:7080"], "balancing": "least-outstanding", "maxAttempts": 2}
+	}`), 0644))
+
+	withDefaults := func(fn func(*Config)) Config {
+		cfg := Default()
+		fn(&cfg)
+		return cfg
+	}
+
+	for _, testCase := range []struct {
+		Name string
+		// inputs
+		Args []string
+		Env  map[string]string
+		// expectations
+		ExpectedConfig Config
+		ExpectedError  error
+	}{
+		{
+			Name:           "defaults",
+			ExpectedConfig: Default(),
+		},
+		{
+			Name: "file",
+			Args: []string{"-config", path},
+			ExpectedConfig: withDefaults(func(c *Config) {
+				c.Addr = ":9090"
+				c.Upstream.Addresses = []string{"http://file:7080"}
+				c.Upstream.Balancing = "least-outstanding"
+				c.Upstream.MaxAttempts = 2
+			}),
+		},
+		{
+			Name: "environment overrides file",
+			Env: map[string]string{
+				FileEnv:                     path,
+				"REPOSITORIES_ADDR":         ":9191",
+				"REPOSITORIES_EJECT_FOR":    "1m",
+				"REPOSITORIES_MAX_ATTEMPTS": "3",
+			},
+			ExpectedConfig: withDefaults(func(c *Config) {
+				c.Addr = ":9191"
+				c.Upstream.Addresses = []string{"http://file:7080"}
+				c.Upstream.Balancing = "least-outstanding"
+				c.Upstream.MaxAttempts = 3
+				c.Upstream.EjectFor = Duration(time.Minute)
+			}),
+		},
+		{
+			Name: "flags override environment",
+			Args: []string{"-config", path, "-addr", ":9292", "-repository-addr", "http://a:7080, http://b:7080"},
+			Env:  map[string]string{"REPOSITORIES_ADDR": ":9191"},
+			ExpectedConfig: withDefaults(func(c *Config) {
+				c.Addr = ":9292"
+				c.Upstream.Addresses = []string{"http://a:7080", "http://b:7080"}
+				c.Upstream.Balancing = "least-outstanding"
+				c.Upstream.MaxAttempts = 2
+			}),
+		},
+		{
+			Name: "addresses with commas in their query",
+			Args: []string{"-repository-addr", "http://a:7080?latency=normal(500ms,100ms),https://b:7080?latency=uniform(1ms,2ms)"},
+			ExpectedConfig: withDefaults(func(c *Config) {
+				c.Upstream.Addresses = []string{"http://a:7080?latency=normal(500ms,100ms)", "https://b:7080?latency=uniform(1ms,2ms)"}
+			}),
+		},
+		{
+			Name:          "invalid environment",
+			Env:           map[string]string{"REPOSITORIES_MAX_ATTEMPTS": "many"},
+			ExpectedError: errors.New(`$REPOSITORIES_MAX_ATTEMPTS: strconv.Atoi: parsing "many": invalid syntax`),
+		},
+		{
+			Name:          "invalid balancing",
+			Args:          []string{"-balancing", "random"},
+			ExpectedError: errors.New(`balancing: unknown balancing "random"`),
+		},
+		{
+			Name:          "relative address",
+			Args:          []string{"-repository-addr", "localhost:7080"},
+			ExpectedError: errors.New(`repository-addr: "localhost:7080" must be an absolute URL`),
+		},
+		{
+			Name:          "no addresses",
+			Args:          []string{"-repository-addr", ""},
+			ExpectedError: errors.New("repository-addr or repository-addr-file must be set"),
+		},
+	} {
+		t.Run(testCase.Name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			flags := NewFlags(fs)
+			require.Nil(t, fs.Parse(testCase.Args))
+
+			cfg, err := flags.Load(func(key string) string { return testCase.Env[key] })
+			if testCase.ExpectedError != nil {
+				assert.Equal(t, testCase.ExpectedError.Error(), err.Error())
+				return
+			}
+
+			require.Nil(t, err)
+			assert.Equal(t, testCase.ExpectedConfig, cfg)
+		})
+	}
+}
+
+func TestPrint(t *testing.T) {
+	cfg := Default()
+	cfg.Server.UpstreamParamsToken = "secret"
+
+	var buf bytes.Buffer
+	require.Nil(t, cfg.Print(&buf))
+
+	assert.Contains(t, buf.String(), `"upstreamParamsToken": "[redacted]"`)
+	assert.NotContains(t, buf.String(), "secret")
+	assert.Equal(t, "secret", cfg.Server.UpstreamParamsToken)
+}
+
+func TestDiff(t *testing.T) {
+	from, to := Default(), Default()
+	to.Addr = ":9090"
+	to.Upstream.MaxAttempts = 3
+	to.Server.UpstreamParamsToken = "secret"
+
+	assert.Equal(t, []Change{
+		{Setting: "addr", From: ":8080", To: ":9090", Restart: true},
+		{Setting: "max-attempts", From: "0", To: "3"},
+		{Setting: "upstream-params-token", From: "", To: "[redacted]"},
+	}, Diff(from, to))
+
+	assert.Empty(t, Diff(from, from))
+}
+
+func TestDiffFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	require.Nil(t, err)
+
+	defer os.RemoveAll(dir)
+
+	var (
+		path = filepath.Join(dir, "profiles.json")
+		load = func(contents string) Config {
+			require.Nil(t, ioutil.WriteFile(path, []byte(contents), 0644))
+
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			require.Nil(t, fs.Parse(nil))
+
+			cfg, err := NewFlags(fs).Load(func(key string) string {
+				return map[string]string{"REPOSITORIES_PROFILES": path}[key]
+			})
+			require.Nil(t, err)
+
+			return cfg
+		}
+		from = load(`{"fast": {"query": {"latency": "0s"}}}`)
+	)
+
+	assert.Empty(t, Diff(from, load(`{"fast": {"query": {"latency": "0s"}}}`)))
+
+	assert.Equal(t, []Change{
+		{Setting: "profiles", From: path, To: path, Reloaded: true},
+	}, Diff(from, load(`{"slow": {"query": {"latency": "1s"}}}`)))
+}
+
+func TestKeepRestart(t *testing.T) {
+	running, loaded := Default(), Default()
+	loaded.Addr = ":9090"
+	loaded.AdminToken = "secret"
+	loaded.LogLevel = "debug"
+
+	cfg := loaded.KeepRestart(running)
+
+	assert.Equal(t, ":8080", cfg.Addr)
+	assert.Equal(t, "", cfg.AdminToken)
+	assert.Equal(t, "debug", cfg.LogLevel)
+}
@@ -0,0 +1,100 @@
+// Package graceful serves HTTP until asked to stop, then drains the
+// requests in flight before cancelling whatever remains.
+package graceful
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// DefaultDrainTimeout is how long requests in flight are given to complete.
+const DefaultDrainTimeout = 30 * time.Second
+
+// ErrDrainTimeout is returned when requests were still in flight once
+// the drain timeout was reached and so had to be cancelled.
+var ErrDrainTimeout = errors.New("drain timeout reached with requests in flight")
+
+// Signals returns a context which is done once the process receives an
+// interrupt or SIGTERM. Further signals are handled as normal, so a second
+// interrupt terminates the process immediately.
+func Signals(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		defer signal.Stop(signals)
+
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// ListenAndServe listens on srv.Addr and serves until ctx is done, see Serve.
+func ListenAndServe(ctx context.Context, srv *http.Server, drain time.Duration) error {
+	addr := srv.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return Serve(ctx, srv, l, drain)
+}
+
+// Serve serves srv on l until ctx is done, over TLS if srv.TLSConfig is
+// set, in which case it must provide the certificate. It then stops accepting
+// connections and waits up to drain for requests in flight to complete,
+// after which their contexts are cancelled so that any calls they are
+// waiting on are abandoned. It returns nil once every request completed
+// in time and ErrDrainTimeout if any had to be cancelled.
+func Serve(ctx context.Context, srv *http.Server, l net.Listener, drain time.Duration) error {
+	base, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv.BaseContext = func(net.Listener) context.Context { return base }
+
+	served := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			served <- srv.ServeTLS(l, "", "")
+			return
+		}
+
+		served <- srv.Serve(l)
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), drain)
+	defer cancelShutdown()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		// cancel the requests still in flight and close their connections
+		cancel()
+		srv.Close()
+
+		return ErrDrainTimeout
+	}
+
+	return nil
+}
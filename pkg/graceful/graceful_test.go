@@ -0,0 +1,74 @@
+package graceful
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServe(t *testing.T) {
+	for _, testCase := range []struct {
+		Name string
+		// how long the request in flight takes
+		Duration time.Duration
+		// expectations
+		ExpectedError     error
+		ExpectedCancelled bool
+	}{
+		{
+			Name:     "drained",
+			Duration: 50 * time.Millisecond,
+		},
+		{
+			Name:              "drain timeout",
+			Duration:          time.Minute,
+			ExpectedError:     ErrDrainTimeout,
+			ExpectedCancelled: true,
+		},
+	} {
+		t.Run(testCase.Name, func(t *testing.T) {
+			var (
+				started   = make(chan struct{})
+				cancelled = make(chan bool, 1)
+				srv       = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					close(started)
+
+					select {
+					case <-time.After(testCase.Duration):
+						cancelled <- false
+					case <-r.Context().Done():
+						cancelled <- true
+					}
+				})}
+			)
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			require.Nil(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			served := make(chan error, 1)
+			go func() {
+				served <- Serve(ctx, srv, l, 200*time.Millisecond)
+			}()
+
+			go http.Get("http://" + l.Addr().String())
+
+			<-started
+			cancel()
+
+			assert.Equal(t, testCase.ExpectedError, <-served)
+			assert.Equal(t, testCase.ExpectedCancelled, <-cancelled)
+
+			// no further connections are accepted
+			_, err = http.Get("http://" + l.Addr().String())
+			assert.NotNil(t, err)
+		})
+	}
+}
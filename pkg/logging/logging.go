@@ -0,0 +1,150 @@
+// Package logging builds structured loggers and carries a request scoped
+// logger, request ID, trace context and counters of upstream activity in
+// a context.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+)
+
+// Format is how log records are encoded.
+type Format string
+
+const (
+	// JSON writes one JSON object per record.
+	JSON Format = "json"
+	// Logfmt writes one line of key=value pairs per record.
+	Logfmt Format = "logfmt"
+)
+
+// ParseFormat parses the name of a Format.
+func ParseFormat(v string) (Format, error) {
+	switch f := Format(v); f {
+	case JSON, Logfmt:
+		return f, nil
+	}
+
+	return "", fmt.Errorf("unknown log format %q", v)
+}
+
+// ParseLevel parses a level such as debug, info, warn or error.
+func ParseLevel(v string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(strings.TrimSpace(v)))
+
+	return level, err
+}
+
+// New returns a logger writing records at or above level to w in format.
+// The level may be changed while the logger is in use.
+func New(w io.Writer, format Format, level slog.Leveler) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == JSON {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// discard is the logger used when a context carries none.
+var discard = slog.New(slog.DiscardHandler)
+
+type (
+	loggerKey    struct{}
+	requestIDKey struct{}
+	countersKey  struct{}
+)
+
+// WithLogger returns a copy of ctx carrying logger.
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext returns the logger carried by ctx,
+// or one which discards every record.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+
+	return discard
+}
+
+// WithRequestID returns a copy of ctx carrying the ID of the request it serves.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the ID of the request ctx serves, if any.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Counters count the upstream activity made to serve a request.
+// The methods of a nil *Counters do nothing.
+type Counters struct {
+	attempts   atomic.Int64
+	retries    atomic.Int64
+	duplicates atomic.Int64
+	cacheFills atomic.Int64
+}
+
+// WithCounters returns a copy of ctx carrying new counters.
+func WithCounters(ctx context.Context) (context.Context, *Counters) {
+	c := &Counters{}
+	return context.WithValue(ctx, countersKey{}, c), c
+}
+
+// CountersFromContext returns the counters carried by ctx, or nil.
+func CountersFromContext(ctx context.Context) *Counters {
+	c, _ := ctx.Value(countersKey{}).(*Counters)
+	return c
+}
+
+// Attempt counts a call made to the repository service.
+func (c *Counters) Attempt() {
+	if c != nil {
+		c.attempts.Add(1)
+	}
+}
+
+// Retry counts a call which is retried against another upstream.
+func (c *Counters) Retry() {
+	if c != nil {
+		c.retries.Add(1)
+	}
+}
+
+// Duplicate counts a repository rejected as it had already been collected.
+func (c *Counters) Duplicate() {
+	if c != nil {
+		c.duplicates.Add(1)
+	}
+}
+
+// CacheFill counts a repository served from the cache.
+func (c *Counters) CacheFill() {
+	if c != nil {
+		c.cacheFills.Add(1)
+	}
+}
+
+// Attrs returns the counts as log attributes.
+func (c *Counters) Attrs() []slog.Attr {
+	if c == nil {
+		return nil
+	}
+
+	return []slog.Attr{
+		slog.Int64("attempts", c.attempts.Load()),
+		slog.Int64("retries", c.retries.Load()),
+		slog.Int64("duplicates", c.duplicates.Load()),
+		slog.Int64("cacheFills", c.cacheFills.Load()),
+	}
+}
@@ -0,0 +1,154 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	// RequestIDHeader carries the ID of a request between services.
+	RequestIDHeader = "X-Request-ID"
+	// TraceparentHeader carries the W3C trace context of a request.
+	TraceparentHeader = "traceparent"
+	// TracestateHeader carries vendor specific trace context alongside it.
+	TracestateHeader = "tracestate"
+	// maxRequestIDLength bounds the request IDs accepted from clients.
+	maxRequestIDLength = 128
+	// maxTracestateLength is the length beyond which W3C trace
+	// context allows tracestate to be dropped.
+	maxTracestateLength = 512
+)
+
+// NewRequestID returns a random request ID.
+func NewRequestID() string {
+	return randomHex(8)
+}
+
+// ValidRequestID reports whether id is fit to be accepted from a client,
+// which it is when it is short and made of printable ASCII.
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Traceparent is the W3C trace context of a request, identifying the
+// trace it belongs to and the span which made it. State is the value
+// of the tracestate header, which is forwarded unchanged.
+type Traceparent struct {
+	TraceID  string
+	ParentID string
+	Flags    string
+	State    string
+}
+
+// NewTraceparent returns the context of a new trace, which is not sampled.
+func NewTraceparent() Traceparent {
+	return Traceparent{
+		TraceID:  randomHex(16),
+		ParentID: randomHex(8),
+		Flags:    "00",
+	}
+}
+
+// ParseTraceparent parses a version 00 traceparent header value.
+func ParseTraceparent(v string) (Traceparent, error) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return Traceparent{}, fmt.Errorf("invalid traceparent %q", v)
+	}
+
+	tp := Traceparent{TraceID: parts[1], ParentID: parts[2], Flags: parts[3]}
+	if !lowerHex(tp.TraceID, 32) || !lowerHex(tp.ParentID, 16) || !lowerHex(tp.Flags, 2) ||
+		strings.Trim(tp.TraceID, "0") == "" || strings.Trim(tp.ParentID, "0") == "" {
+		return Traceparent{}, fmt.Errorf("invalid traceparent %q", v)
+	}
+
+	return tp, nil
+}
+
+// Child returns the context of a span made within tp's trace.
+func (tp Traceparent) Child() Traceparent {
+	tp.ParentID = randomHex(8)
+	return tp
+}
+
+// ParseTracestate returns the tracestate of header, combining several
+// header lines, or nothing when it is too long to be forwarded.
+func ParseTracestate(header http.Header) string {
+	state := strings.Join(header.Values(TracestateHeader), ",")
+	if len(state) > maxTracestateLength {
+		return ""
+	}
+
+	return state
+}
+
+// String returns the traceparent header value of tp.
+func (tp Traceparent) String() string {
+	return "00-" + tp.TraceID + "-" + tp.ParentID + "-" + tp.Flags
+}
+
+type traceparentKey struct{}
+
+// WithTraceparent returns a copy of ctx carrying the trace context of the request it serves.
+func WithTraceparent(ctx context.Context, tp Traceparent) context.Context {
+	return context.WithValue(ctx, traceparentKey{}, tp)
+}
+
+// TraceparentFromContext returns the trace context carried by ctx, if any.
+func TraceparentFromContext(ctx context.Context) (Traceparent, bool) {
+	tp, ok := ctx.Value(traceparentKey{}).(Traceparent)
+	return tp, ok
+}
+
+// Propagate sets the request ID and trace context carried by ctx on header,
+// so that a call made while serving a request can be correlated with it.
+func Propagate(ctx context.Context, header http.Header) {
+	if id := RequestID(ctx); id != "" {
+		header.Set(RequestIDHeader, id)
+	}
+
+	if tp, ok := TraceparentFromContext(ctx); ok {
+		header.Set(TraceparentHeader, tp.String())
+
+		if tp.State != "" {
+			header.Set(TracestateHeader, tp.State)
+		}
+	}
+}
+
+func lowerHex(v string, length int) bool {
+	if len(v) != length {
+		return false
+	}
+
+	for _, c := range v {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,20 @@
+package models
+
+type EventType string
+
+const (
+	// EventRepository is emitted when a repository has been
+	// collected for a slot of the response.
+	EventRepository EventType = "repository"
+	// EventRetry is emitted when a fetched repository was rejected
+	// and the slot is being fetched again.
+	EventRetry EventType = "retry"
+)
+
+// Event describes progress made while collecting repositories.
+type Event struct {
+	Type       EventType
+	Slot       int
+	Repository Repository
+	Reason     string
+}
@@ -6,4 +6,7 @@ type Repository struct {
 	ID        int       `json:"id"`
 	Name      string    `json:"name"`
 	FetchedAt time.Time `json:"fetchedAt"`
+	// ETag is the entity tag given to the repository by the
+	// repository service, if any.
+	ETag string `json:"-"`
 }
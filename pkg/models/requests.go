@@ -1,8 +1,37 @@
 package models
 
+import (
+	"errors"
+	"net/url"
+	"time"
+)
+
+// ErrInvalidRequest is wrapped by errors caused by
+// a request which can never be satisfied.
+var ErrInvalidRequest = errors.New("invalid request")
+
 type RepositoriesRequest struct {
 	Count  int
 	Unique bool
+	// IDs requests specific repositories rather than random ones.
+	IDs []int
+	// Stable returns repositories in slot order rather than
+	// the order in which they were collected.
+	Stable bool
+	Sort   Sort
+	// Timeout bounds the time spent collecting repositories.
+	// Once reached the repositories collected so far are returned,
+	// along with cached repositories for the slots left unfilled.
+	Timeout time.Duration
+	// CacheOnly serves repositories from those already
+	// fetched without calling the repository service.
+	CacheOnly bool
+	// UpstreamProfile names the profile used to call the
+	// repository service, overriding the configured default.
+	UpstreamProfile string
+	// UpstreamParams are added to the query of every
+	// call made to the repository service.
+	UpstreamParams url.Values
 }
 
 func NewRepositoriesRequest(opts ...Option) RepositoriesRequest {
@@ -29,6 +58,47 @@ func WithCount(count int) Option {
 	}
 }
 
+// WithIDs requests the repositories identified by ids,
+// setting the count to match.
+func WithIDs(ids ...int) Option {
+	return func(r *RepositoriesRequest) {
+		r.IDs = ids
+		r.Count = len(ids)
+	}
+}
+
 func Unique(r *RepositoriesRequest) {
 	r.Unique = true
 }
+
+func Stable(r *RepositoriesRequest) {
+	r.Stable = true
+}
+
+func CacheOnly(r *RepositoriesRequest) {
+	r.CacheOnly = true
+}
+
+func SortBy(sort Sort) Option {
+	return func(r *RepositoriesRequest) {
+		r.Sort = sort
+	}
+}
+
+func WithTimeout(timeout time.Duration) Option {
+	return func(r *RepositoriesRequest) {
+		r.Timeout = timeout
+	}
+}
+
+func WithUpstreamProfile(name string) Option {
+	return func(r *RepositoriesRequest) {
+		r.UpstreamProfile = name
+	}
+}
+
+func WithUpstreamParams(params url.Values) Option {
+	return func(r *RepositoriesRequest) {
+		r.UpstreamParams = params
+	}
+}
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type SortKey string
+
+const (
+	SortByID        SortKey = "id"
+	SortByName      SortKey = "name"
+	SortByFetchedAt SortKey = "fetchedAt"
+)
+
+// Sort describes the order in which repositories are returned.
+// The zero value leaves the order untouched.
+type Sort struct {
+	Key        SortKey
+	Descending bool
+}
+
+// ParseSort parses a sort expression such as "name" or "-fetchedAt".
+// A leading "-" reverses the order.
+func ParseSort(v string) (Sort, error) {
+	var s Sort
+
+	if strings.HasPrefix(v, "-") {
+		s.Descending = true
+		v = v[1:]
+	}
+
+	switch key := SortKey(v); key {
+	case SortByID, SortByName, SortByFetchedAt:
+		s.Key = key
+	default:
+		return Sort{}, fmt.Errorf("unsupported sort key %q", v)
+	}
+
+	return s, nil
+}
+
+func (s Sort) String() string {
+	if s.Descending {
+		return "-" + string(s.Key)
+	}
+
+	return string(s.Key)
+}
+
+// Apply sorts repos in place.
+func (s Sort) Apply(repos []Repository) {
+	var less func(a, b Repository) bool
+
+	switch s.Key {
+	case SortByID:
+		less = func(a, b Repository) bool { return a.ID < b.ID }
+	case SortByName:
+		less = func(a, b Repository) bool { return a.Name < b.Name }
+	case SortByFetchedAt:
+		less = func(a, b Repository) bool { return a.FetchedAt.Before(b.FetchedAt) }
+	default:
+		return
+	}
+
+	sort.SliceStable(repos, func(i, j int) bool {
+		if s.Descending {
+			return less(repos[j], repos[i])
+		}
+
+		return less(repos[i], repos[j])
+	})
+}
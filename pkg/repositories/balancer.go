@@ -0,0 +1,327 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/georgemac/repositories/pkg/logging"
+)
+
+// Balancing selects the upstream each call to the repository service is made to.
+type Balancing string
+
+const (
+	// RoundRobin cycles through the upstreams in turn.
+	RoundRobin Balancing = "round-robin"
+	// LeastOutstanding picks the upstream with the fewest calls in flight.
+	LeastOutstanding Balancing = "least-outstanding"
+	// LatencyWeighted picks upstreams at random weighted
+	// by the inverse of their recent latency.
+	LatencyWeighted Balancing = "latency-weighted"
+)
+
+const (
+	// DefaultEjectAfter is the number of consecutive failures
+	// after which an upstream is ejected.
+	DefaultEjectAfter = 5
+	// DefaultEjectFor is how long an ejected upstream is avoided.
+	DefaultEjectFor = 30 * time.Second
+	// latencyDecay is the weight given to the latest
+	// sample in an upstream's moving average latency.
+	latencyDecay = 0.3
+)
+
+// ParseBalancing parses the name of a Balancing strategy.
+func ParseBalancing(v string) (Balancing, error) {
+	switch b := Balancing(v); b {
+	case RoundRobin, LeastOutstanding, LatencyWeighted:
+		return b, nil
+	}
+
+	return "", fmt.Errorf("unknown balancing %q", v)
+}
+
+// WithUpstreams adds further addresses of the repository service,
+// which are called alongside the address given to New.
+func WithUpstreams(addresses ...string) Option {
+	return func(s *Service) {
+		s.addresses = append(s.addresses, addresses...)
+	}
+}
+
+// WithBalancing configures how calls are spread across upstreams.
+// It defaults to RoundRobin.
+func WithBalancing(b Balancing) Option {
+	return func(s *Service) {
+		s.pool.balancing = b
+	}
+}
+
+// WithMaxAttempts limits the number of upstreams a failed call is
+// attempted against. It defaults to attempting every upstream once.
+func WithMaxAttempts(attempts int) Option {
+	return func(s *Service) {
+		s.maxAttempts = attempts
+	}
+}
+
+// WithEjection configures passive health tracking: an upstream which
+// fails after times in a row is avoided for duration. An after of 0
+// disables ejection.
+func WithEjection(after int, duration time.Duration) Option {
+	return func(s *Service) {
+		s.pool.ejectAfter, s.pool.ejectFor = after, duration
+	}
+}
+
+var errNoUpstreams = errors.New("no repository service upstreams configured")
+
+// statusError is returned when the repository
+// service responds with an unexpected status.
+type statusError struct {
+	code int
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("repository service responded with status %d", e.code)
+}
+
+// failover reports whether err is worth attempting against another
+// upstream, which is the case unless the upstream understood and
+// refused the call.
+func failover(err error) bool {
+	var status statusError
+	if errors.As(err, &status) {
+		return status.code >= http.StatusInternalServerError || status.code == http.StatusTooManyRequests
+	}
+
+	return true
+}
+
+// backend is a single upstream address of the repository service.
+type backend struct {
+	url *url.URL
+
+	// guarded by pool.mu
+	outstanding  int
+	latency      time.Duration
+	failures     int
+	ejectedUntil time.Time
+}
+
+// pool balances calls across backends and tracks their health.
+type pool struct {
+	mu         sync.Mutex
+	backends   []*backend
+	next       int
+	balancing  Balancing
+	ejectAfter int
+	ejectFor   time.Duration
+}
+
+func newPool(backends ...*backend) *pool {
+	return &pool{
+		backends:   backends,
+		balancing:  RoundRobin,
+		ejectAfter: DefaultEjectAfter,
+		ejectFor:   DefaultEjectFor,
+	}
+}
+
+// health returns the health of each backend keyed by address,
+// without the calls outstanding against it.
+func (p *pool) health() map[string]backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	health := make(map[string]backend, len(p.backends))
+	for _, b := range p.backends {
+		health[b.url.String()] = backend{
+			latency:      b.latency,
+			failures:     b.failures,
+			ejectedUntil: b.ejectedUntil,
+		}
+	}
+
+	return health
+}
+
+// len returns the number of backends in the pool.
+func (p *pool) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.backends)
+}
+
+// pick selects a backend which has not been tried and marks it as having
+// a call outstanding. Ejected backends are only picked once every healthy
+// backend has been tried. It returns nil once every backend has been tried.
+func (p *pool) pick(tried map[*backend]bool) *backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var (
+		now        = time.Now()
+		candidates []*backend
+		ejected    []*backend
+	)
+
+	// start after the last pick so ties are broken in turn
+	for i := range p.backends {
+		b := p.backends[(p.next+i)%len(p.backends)]
+		switch {
+		case tried[b]:
+		case now.Before(b.ejectedUntil):
+			ejected = append(ejected, b)
+		default:
+			candidates = append(candidates, b)
+		}
+	}
+
+	if len(candidates) == 0 {
+		candidates = ejected
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	picked := candidates[0]
+
+	switch p.balancing {
+	case LeastOutstanding:
+		for _, b := range candidates[1:] {
+			if b.outstanding < picked.outstanding {
+				picked = b
+			}
+		}
+	case LatencyWeighted:
+		picked = weighted(candidates)
+	}
+
+	for i, b := range p.backends {
+		if b == picked {
+			p.next = i + 1
+		}
+	}
+
+	picked.outstanding++
+
+	return picked
+}
+
+// weighted picks one of candidates at random weighted by the inverse
+// of its latency. Backends without a latency sample are picked first
+// so that every backend is measured.
+func weighted(candidates []*backend) *backend {
+	var (
+		weights = make([]float64, len(candidates))
+		total   float64
+	)
+
+	for i, b := range candidates {
+		if b.latency <= 0 {
+			return b
+		}
+
+		weights[i] = 1 / b.latency.Seconds()
+		total += weights[i]
+	}
+
+	n := rand.Float64() * total
+	for i, weight := range weights {
+		if n < weight {
+			return candidates[i]
+		}
+
+		n -= weight
+	}
+
+	return candidates[len(candidates)-1]
+}
+
+// done records the outcome of a call to b which took latency.
+func (p *pool) done(b *backend, latency time.Duration, failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	b.outstanding--
+
+	if failed {
+		b.failures++
+		if p.ejectAfter > 0 && b.failures >= p.ejectAfter {
+			b.ejectedUntil = time.Now().Add(p.ejectFor)
+		}
+
+		return
+	}
+
+	b.failures = 0
+
+	if b.latency == 0 {
+		b.latency = latency
+		return
+	}
+
+	b.latency = time.Duration(latencyDecay*float64(latency) + (1-latencyDecay)*float64(b.latency))
+}
+
+// call calls fn with the address of an upstream, failing over to
+// another upstream when the call fails until the attempts are used up.
+func (s Service) call(ctx context.Context, fn func(*url.URL) error) error {
+	var (
+		tried    = map[*backend]bool{}
+		attempts = s.maxAttempts
+		err      = errNoUpstreams
+		logger   = logging.FromContext(ctx)
+		counters = logging.CountersFromContext(ctx)
+	)
+
+	if attempts <= 0 {
+		attempts = s.pool.len()
+	}
+
+	for attempt := 0; attempt < attempts; attempt++ {
+		b := s.pool.pick(tried)
+		if b == nil {
+			break
+		}
+
+		tried[b] = true
+
+		if attempt > 0 {
+			counters.Retry()
+			logger.DebugContext(ctx, "retrying upstream call", "upstream", b.url.Redacted(), "attempt", attempt+1, "previousError", err)
+		}
+
+		counters.Attempt()
+
+		start := time.Now()
+
+		err = fn(b.url)
+
+		// calls cancelled by the caller do not reflect on the upstream
+		cancelled := ctx.Err() != nil
+
+		s.pool.done(b, time.Since(start), err != nil && !cancelled && failover(err))
+
+		if err != nil {
+			logger.DebugContext(ctx, "upstream call failed", "upstream", b.url.Redacted(), "attempt", attempt+1, "duration", time.Since(start), "error", err)
+		} else {
+			logger.DebugContext(ctx, "upstream call", "upstream", b.url.Redacted(), "attempt", attempt+1, "duration", time.Since(start))
+		}
+
+		if err == nil || cancelled || !failover(err) {
+			return err
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,318 @@
+package repositories
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/georgemac/repositories/pkg/logging"
+	"github.com/georgemac/repositories/pkg/models"
+)
+
+// batchSize is the maximum number of repositories fetched in one call.
+const batchSize = 100
+
+// probeTimeout bounds the detection of a capability, which is
+// detached from the request that happened to need it first.
+const probeTimeout = 10 * time.Second
+
+// capability records whether the repository service supports an
+// optional feature, detected the first time it is needed.
+type capability struct {
+	mu        sync.Mutex
+	known     bool
+	supported bool
+	// probing is closed once the probe in flight, if any, completes
+	probing chan struct{}
+}
+
+// detect returns whether the feature is supported, calling probe until
+// it determines the answer. Concurrent callers share a single probe,
+// which runs on a context detached from ctx so that one cancelled
+// request does not fail detection for the others. Callers treat the
+// feature as unsupported while the answer is unknown.
+func (c *capability) detect(ctx context.Context, probe func(context.Context) (bool, error)) bool {
+	c.mu.Lock()
+
+	if c.known {
+		c.mu.Unlock()
+		return c.supported
+	}
+
+	if c.probing == nil {
+		c.probing = make(chan struct{})
+		go c.run(ctx, probe)
+	}
+
+	probing := c.probing
+	c.mu.Unlock()
+
+	select {
+	case <-probing:
+	case <-ctx.Done():
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.known && c.supported
+}
+
+func (c *capability) run(ctx context.Context, probe func(context.Context) (bool, error)) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), probeTimeout)
+	defer cancel()
+
+	supported, err := probe(ctx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// undetermined answers are probed again next time
+	if err == nil {
+		c.known, c.supported = true, supported
+	}
+
+	close(c.probing)
+	c.probing = nil
+}
+
+// probeBatch detects batch support through the list endpoint, which
+// is served by code hosts supporting the /repository?ids= and ?count=
+// batch forms. Upstreams are assumed to be replicas, so the first to
+// answer decides for them all.
+func (s Service) probeBatch(ctx context.Context, up upstream) (supported bool, err error) {
+	err = s.call(ctx, func(base *url.URL) (err error) {
+		supported, err = s.probeBatchFrom(ctx, base, up)
+		return err
+	})
+
+	return
+}
+
+// probeBatchFrom probes the upstream at base. Only the headers of the
+// upstream profile are used so that misbehaviour configured through
+// query parameters does not affect detection. Batches are unsupported
+// only when the list endpoint is definitely missing, any other failure
+// leaves the answer undetermined.
+func (s Service) probeBatchFrom(ctx context.Context, base *url.URL, up upstream) (bool, error) {
+	up.path, up.query = "/repositories", url.Values{}
+
+	target := *base
+	target.RawQuery = ""
+
+	req, err := up.request(ctx, &target, url.Values{"perPage": {"1"}})
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return false, err
+	}
+
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		return false, nil
+	default:
+		return false, statusError{resp.StatusCode}
+	}
+
+	var list struct {
+		Repositories []models.Repository `json:"repositories"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return false, err
+	}
+
+	if list.Repositories == nil {
+		return false, errors.New("repository service did not list repositories")
+	}
+
+	return true, nil
+}
+
+// streamBatch fetches the repositories identified by ids in batches,
+// calling fn for each in slot order.
+func (s Service) streamBatch(ctx, parent context.Context, req models.RepositoriesRequest, up upstream, ids []int, fn func(models.Event) error) error {
+	filled := map[int]bool{}
+
+	for start := 0; start < len(ids); start += batchSize {
+		end := start + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		values := make([]string, 0, end-start)
+		for _, id := range ids[start:end] {
+			values = append(values, strconv.Itoa(id))
+		}
+
+		batch, err := s.fetchBatch(ctx, up, url.Values{"ids": {strings.Join(values, ",")}})
+		if err != nil {
+			if ctx.Err() != nil {
+				// the request has timed out or been cancelled
+				if err := parent.Err(); err != nil {
+					return err
+				}
+
+				return s.backfill(parent, req, ids, filled, nil, fn)
+			}
+
+			return err
+		}
+
+		repos := make(map[int]models.Repository, len(batch))
+		for _, repo := range batch {
+			repos[repo.ID] = repo
+		}
+
+		for i, id := range ids[start:end] {
+			repo, ok := repos[id]
+			if !ok {
+				return fmt.Errorf("repository service did not return repository %d", id)
+			}
+
+			if err := fn(models.Event{
+				Type:       models.EventRepository,
+				Slot:       start + i,
+				Repository: repo,
+			}); err != nil {
+				return err
+			}
+
+			filled[start+i] = true
+		}
+	}
+
+	return nil
+}
+
+// streamRandomBatch fetches req.Count random repositories in batches,
+// calling fn for each in slot order. Duplicates are rejected when
+// req.Unique is set and their slots are filled by later batches.
+func (s Service) streamRandomBatch(ctx, parent context.Context, req models.RepositoriesRequest, up upstream, fn func(models.Event) error) error {
+	var (
+		seen   = map[int]struct{}{}
+		filled = map[int]bool{}
+	)
+
+	for len(filled) < req.Count {
+		size := req.Count - len(filled)
+		if size > batchSize {
+			size = batchSize
+		}
+
+		repos, err := s.fetchBatch(ctx, up, url.Values{"count": {strconv.Itoa(size)}})
+		if err != nil {
+			if ctx.Err() != nil {
+				// the request has timed out or been cancelled
+				if err := parent.Err(); err != nil {
+					return err
+				}
+
+				return s.backfill(parent, req, nil, filled, seen, fn)
+			}
+
+			return err
+		}
+
+		if len(repos) == 0 {
+			return errors.New("repository service returned no repositories")
+		}
+
+		for _, repo := range repos {
+			slot := len(filled)
+			if slot == req.Count {
+				break
+			}
+
+			if _, ok := seen[repo.ID]; ok && req.Unique {
+				logging.CountersFromContext(ctx).Duplicate()
+				logging.FromContext(ctx).DebugContext(ctx, "duplicate rejected", "id", repo.ID, "slot", slot)
+
+				if err := fn(models.Event{
+					Type:       models.EventRetry,
+					Slot:       slot,
+					Repository: repo,
+					Reason:     "duplicate",
+				}); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			seen[repo.ID] = struct{}{}
+			filled[slot] = true
+
+			if err := fn(models.Event{
+				Type:       models.EventRepository,
+				Slot:       slot,
+				Repository: repo,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// fetchBatch fetches the batch of repositories described by query,
+// either by ID with ids or at random with count.
+func (s Service) fetchBatch(ctx context.Context, up upstream, query url.Values) (repos []models.Repository, err error) {
+	err = s.call(ctx, func(base *url.URL) (err error) {
+		repos, err = s.fetchBatchFrom(ctx, base, up, query)
+		return err
+	})
+
+	return
+}
+
+func (s Service) fetchBatchFrom(ctx context.Context, base *url.URL, up upstream, query url.Values) ([]models.Repository, error) {
+	req, err := up.request(ctx, base, query)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError{resp.StatusCode}
+	}
+
+	var batch struct {
+		Repositories []models.Repository `json:"repositories"`
+		// ETags are keyed by repository ID
+		ETags map[string]string `json:"etags"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		return nil, err
+	}
+
+	for i, repo := range batch.Repositories {
+		batch.Repositories[i].ETag = batch.ETags[strconv.Itoa(repo.ID)]
+
+		s.cache.put(cacheEntry{Repository: batch.Repositories[i]})
+	}
+
+	return batch.Repositories, nil
+}
@@ -0,0 +1,120 @@
+package repositories
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/georgemac/repositories/pkg/logging"
+	"github.com/georgemac/repositories/pkg/models"
+)
+
+// cache holds the last version of each repository fetched along with
+// the validators used to revalidate it through a conditional request.
+type cache struct {
+	mu      sync.Mutex
+	entries map[int]cacheEntry
+}
+
+type cacheEntry struct {
+	Repository   models.Repository
+	LastModified string
+}
+
+func newCache() *cache {
+	return &cache{entries: map[int]cacheEntry{}}
+}
+
+func (c *cache) get(id int) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[id]
+
+	return entry, ok
+}
+
+func (c *cache) put(entry cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[entry.Repository.ID] = entry
+}
+
+// repositories returns every cached repository ordered by ID.
+func (c *cache) repositories() []models.Repository {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	repos := make([]models.Repository, 0, len(c.entries))
+	for _, entry := range c.entries {
+		repos = append(repos, entry.Repository)
+	}
+
+	sort.Slice(repos, func(i, j int) bool { return repos[i].ID < repos[j].ID })
+
+	return repos
+}
+
+// streamCached calls fn for the cached repositories described by req,
+// in slot order. Repositories requested by ID which are not cached are
+// left out, as are random repositories once the cache is exhausted.
+func (s Service) streamCached(ctx context.Context, req models.RepositoriesRequest, ids []int, fn func(models.Event) error) error {
+	return s.backfill(ctx, req, ids, nil, nil, fn)
+}
+
+// backfill calls fn with cached repositories for the slots of req which
+// are not yet filled, in slot order. Unique requests are only backfilled
+// with repositories which have not been seen.
+func (s Service) backfill(ctx context.Context, req models.RepositoriesRequest, ids []int, filled map[int]bool, seen map[int]struct{}, fn func(models.Event) error) error {
+	var (
+		counters = logging.CountersFromContext(ctx)
+		cached   []models.Repository
+	)
+
+	if len(ids) == 0 {
+		for _, repo := range s.cache.repositories() {
+			if _, ok := seen[repo.ID]; !ok || !req.Unique {
+				cached = append(cached, repo)
+			}
+		}
+
+		rand.Shuffle(len(cached), func(i, j int) { cached[i], cached[j] = cached[j], cached[i] })
+	}
+
+	for slot := 0; slot < req.Count; slot++ {
+		if filled[slot] {
+			continue
+		}
+
+		var repo models.Repository
+		switch {
+		case len(ids) > 0:
+			entry, ok := s.cache.get(ids[slot])
+			if !ok {
+				continue
+			}
+
+			repo = entry.Repository
+		case len(cached) == 0:
+			return nil
+		case req.Unique:
+			repo, cached = cached[0], cached[1:]
+		default:
+			repo = cached[rand.Intn(len(cached))]
+		}
+
+		counters.CacheFill()
+
+		if err := fn(models.Event{
+			Type:       models.EventRepository,
+			Slot:       slot,
+			Repository: repo,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
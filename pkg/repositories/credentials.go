@@ -0,0 +1,129 @@
+package repositories
+
+import (
+	"bufio"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// TokensEnv is the environment variable from which comma separated
+// bearer tokens are read when none are configured with WithTokens.
+const TokensEnv = "REPOSITORY_TOKENS"
+
+// secret is a credential which is redacted when formatted,
+// so that it is never written to logs or errors.
+type secret string
+
+func (secret) String() string   { return "[redacted]" }
+func (secret) GoString() string { return "[redacted]" }
+
+// credentials rotates through bearer tokens when the
+// repository service rejects the one in use.
+type credentials struct {
+	mu      sync.Mutex
+	tokens  []secret
+	current int
+}
+
+// WithTokens configures the bearer tokens presented to the repository
+// service. The first is used until it is rejected with 401 Unauthorized
+// or 403 Forbidden, at which point the next is tried.
+func WithTokens(tokens ...string) Option {
+	return func(s *Service) {
+		s.credentials = newCredentials(tokens)
+	}
+}
+
+// LoadTokens reads bearer tokens for WithTokens from path, one per line.
+// Blank lines and lines starting with # are ignored, and every other
+// line is presented exactly as written.
+func LoadTokens(path string) (tokens []string, err error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer fi.Close()
+
+	scanner := bufio.NewScanner(fi)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		tokens = append(tokens, line)
+	}
+
+	return tokens, scanner.Err()
+}
+
+func newCredentials(tokens []string) *credentials {
+	c := &credentials{}
+	for _, token := range tokens {
+		if token = strings.TrimSpace(token); token != "" {
+			c.tokens = append(c.tokens, secret(token))
+		}
+	}
+
+	return c
+}
+
+func credentialsFromEnv() *credentials {
+	return newCredentials(strings.Split(os.Getenv(TokensEnv), ","))
+}
+
+func (c *credentials) len() int {
+	return len(c.tokens)
+}
+
+// token returns the token currently in use, if any.
+func (c *credentials) token() (secret, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.tokens) == 0 {
+		return "", false
+	}
+
+	return c.tokens[c.current], true
+}
+
+// rotate moves on from rejected, unless another
+// caller has already done so.
+func (c *credentials) rotate(rejected secret) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.tokens[c.current] == rejected {
+		c.current = (c.current + 1) % len(c.tokens)
+	}
+}
+
+// do sends req with the current credentials, rotating through
+// the remaining tokens while they are rejected. req must not
+// have a body as it may be sent more than once.
+func (s Service) do(req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		token, ok := s.credentials.token()
+		if ok {
+			req.Header.Set("Authorization", "Bearer "+string(token))
+		}
+
+		resp, err := s.cli.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		rejected := resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden
+		if !ok || !rejected || attempt >= s.credentials.len() {
+			return resp, nil
+		}
+
+		resp.Body.Close()
+
+		s.credentials.rotate(token)
+	}
+}
@@ -0,0 +1,159 @@
+package repositories
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// LoadUpstreams reads the addresses of the repository service from path,
+// either as a JSON array of strings or one address per line. Blank
+// lines and lines starting with # are ignored.
+func LoadUpstreams(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var addresses []string
+		if err := json.Unmarshal(trimmed, &addresses); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+
+		return addresses, nil
+	}
+
+	var (
+		addresses []string
+		scanner   = bufio.NewScanner(bytes.NewReader(data))
+	)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		addresses = append(addresses, line)
+	}
+
+	return addresses, scanner.Err()
+}
+
+// SetUpstreams atomically replaces the addresses of the repository service.
+// Calls in flight complete against the upstream they started on, and the
+// health of addresses which remain is kept. The upstreams are left
+// unchanged if any address is invalid or none are given.
+func (s Service) SetUpstreams(addresses []string) error {
+	if len(addresses) == 0 {
+		return errNoUpstreams
+	}
+
+	urls := make([]*url.URL, 0, len(addresses))
+	for _, address := range addresses {
+		u, err := url.Parse(address)
+		if err != nil {
+			return err
+		}
+
+		urls = append(urls, u)
+	}
+
+	s.pool.mu.Lock()
+	defer s.pool.mu.Unlock()
+
+	existing := map[string]*backend{}
+	for _, b := range s.pool.backends {
+		existing[b.url.String()] = b
+	}
+
+	backends := make([]*backend, 0, len(urls))
+	for _, u := range urls {
+		b, ok := existing[u.String()]
+		if !ok {
+			b = &backend{url: u}
+		}
+
+		backends = append(backends, b)
+	}
+
+	s.pool.backends, s.pool.next = backends, 0
+
+	return nil
+}
+
+// Upstreams returns the addresses of the repository service in use.
+func (s Service) Upstreams() []string {
+	s.pool.mu.Lock()
+	defer s.pool.mu.Unlock()
+
+	addresses := make([]string, 0, len(s.pool.backends))
+	for _, b := range s.pool.backends {
+		addresses = append(addresses, b.url.String())
+	}
+
+	return addresses
+}
+
+// WatchUpstreams polls the file at path every interval and replaces the
+// upstreams with the addresses it lists whenever it is modified. Failures
+// to read or apply the file are passed to errs, if not nil, and leave the
+// upstreams unchanged. It blocks until ctx is done.
+func (s Service) WatchUpstreams(ctx context.Context, path string, interval time.Duration, errs func(error)) {
+	var (
+		ticker   = time.NewTicker(interval)
+		modified time.Time
+		size     int64
+	)
+
+	defer ticker.Stop()
+
+	if fi, err := os.Stat(path); err == nil {
+		// the file is assumed to have been loaded already
+		modified, size = fi.ModTime(), fi.Size()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			report(errs, err)
+			continue
+		}
+
+		if fi.ModTime().Equal(modified) && fi.Size() == size {
+			continue
+		}
+
+		modified, size = fi.ModTime(), fi.Size()
+
+		addresses, err := LoadUpstreams(path)
+		if err != nil {
+			report(errs, err)
+			continue
+		}
+
+		if err := s.SetUpstreams(addresses); err != nil {
+			report(errs, fmt.Errorf("%s: %v", path, err))
+		}
+	}
+}
+
+func report(errs func(error), err error) {
+	if errs != nil {
+		errs(err)
+	}
+}
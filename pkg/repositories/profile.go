@@ -0,0 +1,149 @@
+package repositories
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/georgemac/repositories/pkg/logging"
+	"github.com/georgemac/repositories/pkg/models"
+)
+
+// DefaultProfile is the name of the profile used by requests which do
+// not select one. Unless configured, it is built from the query of the
+// address of each upstream.
+const DefaultProfile = "default"
+
+// Profile describes how calls are made to the repository service:
+// the path of the single repository endpoint along with query
+// parameters and headers added to every call.
+type Profile struct {
+	Path    string            `json:"path,omitempty"`
+	Query   map[string]string `json:"query,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// fromAddress adds the query of the upstream address to calls
+	fromAddress bool
+}
+
+// LoadProfiles reads a JSON object of profiles keyed by name from path.
+func LoadProfiles(path string) (profiles map[string]Profile, err error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer fi.Close()
+
+	if err := json.NewDecoder(fi).Decode(&profiles); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return profiles, nil
+}
+
+// WithProfiles adds named profiles which requests can select. A profile
+// named DefaultProfile replaces the one built from the upstream addresses.
+func WithProfiles(profiles map[string]Profile) Option {
+	return func(s *Service) {
+		for name, profile := range profiles {
+			s.profiles[name] = profile
+		}
+	}
+}
+
+// WithProfile selects the profile used by requests which do not name one.
+func WithProfile(name string) Option {
+	return func(s *Service) {
+		s.profile = name
+	}
+}
+
+// upstream describes how the calls for a single request
+// are made to the repository service.
+type upstream struct {
+	path        string
+	query       url.Values
+	header      http.Header
+	fromAddress bool
+}
+
+// upstream resolves the profile and parameters of req.
+func (s Service) upstream(req models.RepositoriesRequest) (upstream, error) {
+	name := req.UpstreamProfile
+	if name == "" {
+		name = s.profile
+	}
+
+	profile, ok := s.profiles[name]
+	if !ok {
+		return upstream{}, fmt.Errorf("%w: unknown upstream profile %q", models.ErrInvalidRequest, name)
+	}
+
+	up := upstream{
+		path:        profile.Path,
+		query:       url.Values{},
+		header:      http.Header{},
+		fromAddress: profile.fromAddress,
+	}
+
+	if up.path == "" {
+		up.path = "/repository"
+	}
+
+	for k, v := range profile.Query {
+		up.query.Set(k, v)
+	}
+
+	for k, v := range req.UpstreamParams {
+		up.query[k] = v
+	}
+
+	for k, v := range profile.Headers {
+		up.header.Set(k, v)
+	}
+
+	return up, nil
+}
+
+// request builds a request for the upstream path relative to base with
+// the query of the upstream and the additional parameters given. The
+// query of base is only used by the profile built from the addresses.
+// It carries the request ID and trace context of the request served by ctx.
+func (u upstream) request(ctx context.Context, base *url.URL, query url.Values) (*http.Request, error) {
+	target, err := base.Parse(u.path)
+	if err != nil {
+		return nil, err
+	}
+
+	values := url.Values{}
+	if u.fromAddress {
+		values = base.Query()
+	}
+
+	for k, v := range u.query {
+		values[k] = v
+	}
+
+	for k, v := range query {
+		values[k] = v
+	}
+
+	target.RawQuery = values.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range u.header {
+		req.Header[k] = v
+	}
+
+	logging.Propagate(ctx, req.Header)
+
+	return req, nil
+}
@@ -2,79 +2,243 @@ package repositories
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
 	"sync"
+	"time"
 
+	"github.com/georgemac/repositories/pkg/logging"
 	"github.com/georgemac/repositories/pkg/models"
 )
 
 type Service struct {
-	cli    *http.Client
-	target *url.URL
+	cli         *http.Client
+	tls         *tls.Config
+	addresses   []string
+	pool        *pool
+	maxAttempts int
+	credentials *credentials
+	batch       *capability
+	cache       *cache
+	profiles    map[string]Profile
+	profile     string
+	// health of upstreams inherited, keyed by address
+	health map[string]backend
 }
 
-func New(repositoryServiceAddress string) (*Service, error) {
-	url, err := url.Parse(repositoryServiceAddress)
+type Option func(s *Service)
+
+// WithClient configures the http.Client used to call the repository service.
+func WithClient(cli *http.Client) Option {
+	return func(s *Service) {
+		s.cli = cli
+	}
+}
+
+// WithTLSConfig configures the TLS client used to call the repository
+// service, e.g. to trust a private CA or present a client certificate.
+// It requires the transport of the http.Client to be an *http.Transport.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(s *Service) {
+		s.tls = cfg
+	}
+}
+
+// Inherit shares the cache and detected capabilities of prev, so that a
+// Service replacing prev with a new configuration carries on where prev
+// left off. The health of upstreams which remain is carried over, so
+// that ejected upstreams stay ejected.
+func Inherit(prev *Service) Option {
+	return func(s *Service) {
+		s.cache, s.batch = prev.cache, prev.batch
+		s.health = prev.pool.health()
+	}
+}
+
+// New returns a Service which calls the repository service at
+// repositoryServiceAddress. The query of each address is added to the
+// calls made to it by requests using the default profile, unless
+// WithProfiles replaces it.
+func New(repositoryServiceAddress string, opts ...Option) (*Service, error) {
+	s := &Service{
+		cli:         &http.Client{},
+		addresses:   []string{repositoryServiceAddress},
+		pool:        newPool(),
+		credentials: credentialsFromEnv(),
+		batch:       &capability{},
+		cache:       newCache(),
+		profiles:    map[string]Profile{DefaultProfile: {fromAddress: true}},
+		profile:     DefaultProfile,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.tls != nil {
+		transport, ok := s.cli.Transport.(*http.Transport)
+		if s.cli.Transport == nil {
+			transport, ok = http.DefaultTransport.(*http.Transport)
+		}
+
+		if !ok {
+			return nil, errors.New("TLS configuration requires an *http.Transport")
+		}
+
+		transport = transport.Clone()
+		transport.TLSClientConfig = s.tls
+
+		cli := *s.cli
+		cli.Transport = transport
+		s.cli = &cli
+	}
+
+	for _, address := range s.addresses {
+		url, err := url.Parse(address)
+		if err != nil {
+			return nil, err
+		}
+
+		b := s.health[url.String()]
+		b.url = url
+
+		s.pool.backends = append(s.pool.backends, &b)
+	}
+
+	return s, nil
+}
+
+func (s Service) Repositories(ctx context.Context, req models.RepositoriesRequest) (repos []models.Repository, err error) {
+	slots := map[int]models.Repository{}
+
+	err = s.StreamRepositories(ctx, req, func(ev models.Event) error {
+		if ev.Type != models.EventRepository {
+			return nil
+		}
+
+		if req.Stable {
+			slots[ev.Slot] = ev.Repository
+		} else {
+			repos = append(repos, ev.Repository)
+		}
+
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return &Service{
-		cli:    &http.Client{},
-		target: url,
-	}, nil
+	if req.Stable {
+		// slots may be missing when the request timed out
+		for i := 0; i < req.Count; i++ {
+			if repo, ok := slots[i]; ok {
+				repos = append(repos, repo)
+			}
+		}
+	}
+
+	req.Sort.Apply(repos)
+
+	return
 }
 
-func (s Service) Repositories(_ context.Context, req models.RepositoriesRequest) (repos []models.Repository, err error) {
+// StreamRepositories calls fn for every event produced while collecting
+// the repositories described by req, in the order they are collected.
+// Returning an error from fn stops collection and the error is returned.
+// When req.Timeout is reached collection stops without an error and the
+// slots not yet filled are backfilled from the cache, as far as it can.
+func (s Service) StreamRepositories(ctx context.Context, req models.RepositoriesRequest, fn func(models.Event) error) error {
 	type task struct {
+		// Slot is the position in the response this task fills
+		Slot   int
 		Result models.Repository
 		Err    error
 	}
 
+	var (
+		parent = ctx
+		cancel context.CancelFunc
+	)
+
+	if req.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, req.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+
+	defer cancel()
+
+	up, err := s.upstream(req)
+	if err != nil {
+		return err
+	}
+
+	ids := req.IDs
+	for _, id := range ids {
+		// an ID of 0 would otherwise fetch a random repository
+		if id <= 0 {
+			return fmt.Errorf("%w: invalid id %d", models.ErrInvalidRequest, id)
+		}
+	}
+
+	if len(ids) > 0 {
+		if req.Unique {
+			ids = dedupe(ids)
+		}
+
+		req.Count = len(ids)
+	}
+
+	if req.Count == 0 {
+		return nil
+	}
+
+	if req.CacheOnly {
+		return s.streamCached(ctx, req, ids, fn)
+	}
+
+	probe := func(ctx context.Context) (bool, error) { return s.probeBatch(ctx, up) }
+	if s.batch.detect(ctx, probe) {
+		if len(ids) > 0 {
+			return s.streamBatch(ctx, parent, req, up, ids, fn)
+		}
+
+		return s.streamRandomBatch(ctx, parent, req, up, fn)
+	}
+
 	var (
 		incoming  = make(chan task, req.Count)
 		collected = make(chan task)
 		wg        sync.WaitGroup
 	)
 
+	defer close(incoming)
+
 	for i := 0; i < req.Count; i++ {
-		incoming <- task{}
+		incoming <- task{Slot: i}
 
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 
 			for in := range incoming {
-				func(in *task) {
-					target, err := s.target.Parse("/repository")
-					if err != nil {
-						in.Err = err
-
-						return
-					}
-
-					resp, err := s.cli.Get(target.String())
-					if err != nil {
-						in.Err = err
-
-						return
-					}
-
-					defer resp.Body.Close()
-
-					var repo repo
-					if err := json.NewDecoder(resp.Body).Decode(&repo); err != nil {
-						in.Err = err
-
-						return
-					}
+				var id int
+				if len(ids) > 0 {
+					id = ids[in.Slot]
+				}
 
-					in.Result = repo.Repository
-				}(&in)
+				in.Result, in.Err = s.fetch(ctx, up, id)
 
-				collected <- in
+				select {
+				case collected <- in:
+				case <-ctx.Done():
+					return
+				}
 			}
 		}()
 	}
@@ -84,33 +248,166 @@ func (s Service) Repositories(_ context.Context, req models.RepositoriesRequest)
 		close(collected)
 	}()
 
-	seen := map[int]struct{}{}
+	var (
+		seen   = map[int]struct{}{}
+		filled = map[int]bool{}
+	)
+
+collect:
+	for {
+		var (
+			resp task
+			ok   bool
+		)
+
+		select {
+		case resp, ok = <-collected:
+			if !ok {
+				// every worker has given up as ctx is done
+				break collect
+			}
+		case <-ctx.Done():
+			// the request has timed out or been cancelled, and idle
+			// workers would otherwise keep collected from closing
+			break collect
+		}
 
-	for resp := range collected {
 		if resp.Err != nil {
-			return nil, resp.Err
+			if ctx.Err() != nil {
+				break collect
+			}
+
+			return resp.Err
 		}
 
-		if _, ok := seen[resp.Result.ID]; ok && req.Unique {
+		if _, ok := seen[resp.Result.ID]; ok && req.Unique && len(ids) == 0 {
 			// try again as this has already been seen
-			incoming <- task{}
+			incoming <- task{Slot: resp.Slot}
+
+			logging.CountersFromContext(ctx).Duplicate()
+			logging.FromContext(ctx).DebugContext(ctx, "duplicate rejected", "id", resp.Result.ID, "slot", resp.Slot)
+
+			if err := fn(models.Event{
+				Type:       models.EventRetry,
+				Slot:       resp.Slot,
+				Repository: resp.Result,
+				Reason:     "duplicate",
+			}); err != nil {
+				return err
+			}
+
 			continue
 		}
 
 		// track that we have now see this ID
 		seen[resp.Result.ID] = struct{}{}
+		filled[resp.Slot] = true
 
-		repos = append(repos, resp.Result)
+		if err := fn(models.Event{
+			Type:       models.EventRepository,
+			Slot:       resp.Slot,
+			Repository: resp.Result,
+		}); err != nil {
+			return err
+		}
 
-		if len(repos) == req.Count {
-			close(incoming)
-			return
+		if len(filled) == req.Count {
+			return nil
 		}
 	}
 
+	// collection only stops early once ctx is done, which is
+	// not an error if it was due to the request timeout
+	if err := parent.Err(); err != nil {
+		return err
+	}
+
+	return s.backfill(parent, req, ids, filled, seen, fn)
+}
+
+// fetch fetches the repository identified by id, or a random repository
+// when id is 0. Cached repositories are revalidated with a conditional
+// request and a 304 Not Modified response refreshes the cached copy.
+func (s Service) fetch(ctx context.Context, up upstream, id int) (repo models.Repository, err error) {
+	err = s.call(ctx, func(base *url.URL) (err error) {
+		repo, err = s.fetchFrom(ctx, base, up, id)
+		return err
+	})
+
 	return
 }
 
+func (s Service) fetchFrom(ctx context.Context, base *url.URL, up upstream, id int) (models.Repository, error) {
+	query := url.Values{}
+	if id > 0 {
+		query.Set("id", strconv.Itoa(id))
+	}
+
+	req, err := up.request(ctx, base, query)
+	if err != nil {
+		return models.Repository{}, err
+	}
+
+	cached, isCached := s.cache.get(id)
+	if id > 0 && isCached {
+		if cached.Repository.ETag != "" {
+			req.Header.Set("If-None-Match", cached.Repository.ETag)
+		}
+
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return models.Repository{}, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && isCached {
+		cached.Repository.FetchedAt = time.Now()
+		s.cache.put(cached)
+
+		logging.CountersFromContext(ctx).CacheFill()
+
+		return cached.Repository, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return models.Repository{}, statusError{resp.StatusCode}
+	}
+
+	var repo repo
+	if err := json.NewDecoder(resp.Body).Decode(&repo); err != nil {
+		return models.Repository{}, err
+	}
+
+	repo.Repository.ETag = resp.Header.Get("ETag")
+
+	s.cache.put(cacheEntry{
+		Repository:   repo.Repository,
+		LastModified: resp.Header.Get("Last-Modified"),
+	})
+
+	return repo.Repository, nil
+}
+
 type repo struct {
 	Repository models.Repository `json:"repository"`
 }
+
+func dedupe(ids []int) (unique []int) {
+	seen := map[int]struct{}{}
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+
+		seen[id] = struct{}{}
+		unique = append(unique, id)
+	}
+
+	return
+}
@@ -2,11 +2,21 @@ package repositories
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
-	"sort"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/georgemac/repositories/pkg/codehost"
 	"github.com/georgemac/repositories/pkg/models"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -17,17 +27,19 @@ var (
 	yesterday  = today.Add(-time.Hour * 24).UTC()
 	twoDaysAgo = yesterday.Add(-time.Hour * 24).UTC()
 
-	repoA = models.Repository{1, "foo", today}
-	repoB = models.Repository{2, "bar", yesterday}
-	repoC = models.Repository{3, "baz", twoDaysAgo}
+	repoA = models.Repository{ID: 1, Name: "foo", FetchedAt: today}
+	repoB = models.Repository{ID: 2, Name: "bar", FetchedAt: yesterday}
+	repoC = models.Repository{ID: 3, Name: "baz", FetchedAt: twoDaysAgo}
+
+	byID = models.SortBy(models.Sort{Key: models.SortByID})
 )
 
 func TestRepositories(t *testing.T) {
 
 	for _, testCase := range []struct {
 		Name string
-		// available repos
-		Repositories []models.Repository
+		// code host responses
+		Script []codehost.Response
 		// inputs
 		Request models.RepositoriesRequest
 		// expectations
@@ -36,34 +48,50 @@ func TestRepositories(t *testing.T) {
 	}{
 		{
 			Name:                 "fetch one repo",
-			Repositories:         []models.Repository{repoA, repoB},
-			Request:              models.NewRepositoriesRequest(),
+			Script:               respond(repoA, repoB),
+			Request:              models.NewRepositoriesRequest(byID),
 			ExpectedRepositories: []models.Repository{repoA},
 		},
 		{
 			Name:                 "fetch two repos",
-			Repositories:         []models.Repository{repoB, repoC},
-			Request:              models.NewRepositoriesRequest(models.WithCount(2)),
+			Script:               respond(repoB, repoC),
+			Request:              models.NewRepositoriesRequest(models.WithCount(2), byID),
 			ExpectedRepositories: []models.Repository{repoB, repoC},
 		},
 		{
 			Name:                 "fetch three repos",
-			Repositories:         []models.Repository{repoA, repoB, repoB, repoB, repoC},
-			Request:              models.NewRepositoriesRequest(models.WithCount(3)),
+			Script:               respond(repoA, repoB, repoB, repoB, repoC),
+			Request:              models.NewRepositoriesRequest(models.WithCount(3), byID),
 			ExpectedRepositories: []models.Repository{repoA, repoB, repoB},
 		},
 		{
 			Name:                 "fetch three unique repos",
-			Repositories:         []models.Repository{repoA, repoB, repoB, repoB, repoC},
-			Request:              models.NewRepositoriesRequest(models.WithCount(3), models.Unique),
+			Script:               respond(repoA, repoB, repoB, repoB, repoC),
+			Request:              models.NewRepositoriesRequest(models.WithCount(3), models.Unique, byID),
 			ExpectedRepositories: []models.Repository{repoA, repoB, repoC},
 		},
+		{
+			Name:                 "fetch three unique repos sorted by name descending",
+			Script:               respond(repoA, repoB, repoB, repoB, repoC),
+			Request:              models.NewRepositoriesRequest(models.WithCount(3), models.Unique, models.SortBy(models.Sort{Key: models.SortByName, Descending: true})),
+			ExpectedRepositories: []models.Repository{repoA, repoC, repoB},
+		},
+		{
+			Name:                 "fetch three stable sorted repos",
+			Script:               respond(repoC, repoA, repoB),
+			Request:              models.NewRepositoriesRequest(models.WithCount(3), models.Stable, byID),
+			ExpectedRepositories: []models.Repository{repoA, repoB, repoC},
+		},
+		{
+			Name:          "code host error",
+			Script:        []codehost.Response{codehost.Fail(http.StatusInternalServerError)},
+			Request:       models.NewRepositoriesRequest(),
+			ExpectedError: statusError{code: http.StatusInternalServerError},
+		},
 	} {
 		t.Run(testCase.Name, func(t *testing.T) {
 			var (
-				testService = &repositoryService{
-					repositories: testCase.Repositories,
-				}
+				testService              = codehost.New(codehost.WithScript(testCase.Script...), codehost.Loop)
 				testServer               = httptest.NewServer(testService)
 				repositoriesService, err = New(testServer.URL)
 			)
@@ -78,14 +106,914 @@ func TestRepositories(t *testing.T) {
 				return
 			}
 
-			// sort resp as this is non-deterministic due to concurrency
-			sort.Slice(resp, func(i, j int) bool {
-				return resp[i].ID < resp[j].ID
-			})
-
 			require.Nil(t, testCase.ExpectedError)
 
 			assert.Equal(t, testCase.ExpectedRepositories, resp)
 		})
 	}
 }
+
+func TestStreamRepositories(t *testing.T) {
+	var (
+		testService              = codehost.New(codehost.WithScript(respond(repoA, repoA, repoB)...))
+		testServer               = httptest.NewServer(testService)
+		repositoriesService, err = New(testServer.URL)
+	)
+
+	defer testServer.Close()
+
+	require.Nil(t, err)
+
+	var types []models.EventType
+
+	err = repositoriesService.StreamRepositories(context.TODO(), models.NewRepositoriesRequest(models.WithCount(2), models.Unique), func(ev models.Event) error {
+		types = append(types, ev.Type)
+		return nil
+	})
+	require.Nil(t, err)
+
+	assert.Equal(t, []models.EventType{models.EventRepository, models.EventRetry, models.EventRepository}, types)
+
+	testService.AssertExhausted(t)
+	testService.AssertCalls(t, 3)
+}
+
+func TestRepositoriesStable(t *testing.T) {
+	for _, testCase := range []struct {
+		Name string
+		// inputs
+		Request models.RepositoriesRequest
+		// expectations
+		ExpectedIDs []int
+	}{
+		{
+			Name:        "in the order answered",
+			Request:     models.NewRepositoriesRequest(models.WithIDs(1, 2, 3)),
+			ExpectedIDs: []int{3, 2, 1},
+		},
+		{
+			Name:        "in slot order when stable",
+			Request:     models.NewRepositoriesRequest(models.WithIDs(1, 2, 3), models.Stable),
+			ExpectedIDs: []int{1, 2, 3},
+		},
+	} {
+		t.Run(testCase.Name, func(t *testing.T) {
+			var (
+				testService = codehost.New(codehost.WithBehaviour(codehost.Behaviour{}))
+				testServer  = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.URL.Path == "/repositories" {
+						// without batches each ID is fetched on its own
+						w.WriteHeader(http.StatusNotFound)
+						return
+					}
+
+					// the later the slot the sooner it is answered
+					id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+					time.Sleep(time.Duration(4-id) * 50 * time.Millisecond)
+
+					testService.ServeHTTP(w, r)
+				}))
+				repositoriesService, err = New(testServer.URL)
+			)
+
+			defer testServer.Close()
+
+			require.Nil(t, err)
+
+			resp, err := repositoriesService.Repositories(context.TODO(), testCase.Request)
+			require.Nil(t, err)
+
+			var ids []int
+			for _, repo := range resp {
+				ids = append(ids, repo.ID)
+			}
+
+			assert.Equal(t, testCase.ExpectedIDs, ids)
+		})
+	}
+}
+
+func respond(repos ...models.Repository) (responses []codehost.Response) {
+	for _, repo := range repos {
+		responses = append(responses, codehost.Respond(repo))
+	}
+
+	return
+}
+
+func TestRepositoriesByID(t *testing.T) {
+	for _, testCase := range []struct {
+		Name    string
+		Options []codehost.Option
+		// expectations
+		ExpectedCalls int
+	}{
+		{
+			Name:          "batch supported",
+			Options:       []codehost.Option{codehost.WithBehaviour(codehost.Behaviour{})},
+			ExpectedCalls: 1,
+		},
+		{
+			Name:          "batch not supported",
+			Options:       []codehost.Option{codehost.WithBehaviour(codehost.Behaviour{}), codehost.WithoutBatch},
+			ExpectedCalls: 3,
+		},
+	} {
+		t.Run(testCase.Name, func(t *testing.T) {
+			var (
+				testService              = codehost.New(testCase.Options...)
+				testServer               = httptest.NewServer(testService)
+				repositoriesService, err = New(testServer.URL)
+			)
+
+			defer testServer.Close()
+
+			require.Nil(t, err)
+
+			resp, err := repositoriesService.Repositories(context.TODO(), models.NewRepositoriesRequest(models.WithIDs(3, 1, 3), models.Stable))
+			require.Nil(t, err)
+
+			var ids []int
+			for _, repo := range resp {
+				ids = append(ids, repo.ID)
+			}
+
+			assert.Equal(t, []int{3, 1, 3}, ids)
+
+			testService.AssertCalls(t, testCase.ExpectedCalls)
+		})
+	}
+}
+
+func TestRepositoriesBatchCount(t *testing.T) {
+	for _, testCase := range []struct {
+		Name    string
+		Options []codehost.Option
+		Count   int
+		// expectations
+		ExpectedCalls int
+	}{
+		{
+			Name:          "batch supported",
+			Options:       []codehost.Option{codehost.WithBehaviour(codehost.Behaviour{})},
+			Count:         50,
+			ExpectedCalls: (50 + batchSize - 1) / batchSize,
+		},
+		{
+			Name:          "several batches",
+			Options:       []codehost.Option{codehost.WithBehaviour(codehost.Behaviour{})},
+			Count:         250,
+			ExpectedCalls: (250 + batchSize - 1) / batchSize,
+		},
+		{
+			Name:          "batch not supported",
+			Options:       []codehost.Option{codehost.WithBehaviour(codehost.Behaviour{}), codehost.WithoutBatch},
+			Count:         50,
+			ExpectedCalls: 50,
+		},
+	} {
+		t.Run(testCase.Name, func(t *testing.T) {
+			var (
+				testService              = codehost.New(testCase.Options...)
+				testServer               = httptest.NewServer(testService)
+				repositoriesService, err = New(testServer.URL)
+			)
+
+			defer testServer.Close()
+
+			require.Nil(t, err)
+
+			resp, err := repositoriesService.Repositories(context.TODO(), models.NewRepositoriesRequest(models.WithCount(testCase.Count)))
+			require.Nil(t, err)
+
+			assert.Len(t, resp, testCase.Count)
+
+			testService.AssertCalls(t, testCase.ExpectedCalls)
+		})
+	}
+}
+
+func TestBatchDetection(t *testing.T) {
+	for _, testCase := range []struct {
+		Name string
+		// status of the list endpoint, which is served as normal on 200
+		Status int
+		// expectations
+		ExpectedProbes int
+		ExpectedCalls  int
+	}{
+		{
+			Name:           "supported",
+			Status:         http.StatusOK,
+			ExpectedProbes: 1,
+			ExpectedCalls:  2,
+		},
+		{
+			Name:           "not found",
+			Status:         http.StatusNotFound,
+			ExpectedProbes: 1,
+			ExpectedCalls:  6,
+		},
+		{
+			Name:           "method not allowed",
+			Status:         http.StatusMethodNotAllowed,
+			ExpectedProbes: 1,
+			ExpectedCalls:  6,
+		},
+		{
+			Name:           "bad request is probed again",
+			Status:         http.StatusBadRequest,
+			ExpectedProbes: 2,
+			ExpectedCalls:  6,
+		},
+		{
+			Name:           "unavailable is probed again",
+			Status:         http.StatusServiceUnavailable,
+			ExpectedProbes: 2,
+			ExpectedCalls:  6,
+		},
+	} {
+		t.Run(testCase.Name, func(t *testing.T) {
+			var (
+				probes      int32
+				testService = codehost.New(codehost.WithBehaviour(codehost.Behaviour{}))
+				testServer  = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.URL.Path == "/repositories" {
+						atomic.AddInt32(&probes, 1)
+
+						if testCase.Status != http.StatusOK {
+							w.WriteHeader(testCase.Status)
+							return
+						}
+					}
+
+					testService.ServeHTTP(w, r)
+				}))
+				repositoriesService, err = New(testServer.URL)
+			)
+
+			defer testServer.Close()
+
+			require.Nil(t, err)
+
+			for i := 0; i < 2; i++ {
+				_, err := repositoriesService.Repositories(context.TODO(), models.NewRepositoriesRequest(models.WithCount(3)))
+				require.Nil(t, err)
+			}
+
+			assert.Equal(t, int32(testCase.ExpectedProbes), atomic.LoadInt32(&probes))
+
+			testService.AssertCalls(t, testCase.ExpectedCalls)
+		})
+	}
+}
+
+func TestBatchDetectionCancelled(t *testing.T) {
+	var (
+		probes      int32
+		release     = make(chan struct{})
+		testService = codehost.New(codehost.WithBehaviour(codehost.Behaviour{}))
+		testServer  = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/repositories" {
+				atomic.AddInt32(&probes, 1)
+				<-release
+			}
+
+			testService.ServeHTTP(w, r)
+		}))
+		repositoriesService, err = New(testServer.URL)
+	)
+
+	defer testServer.Close()
+
+	require.Nil(t, err)
+
+	// the first request gives up while the probe is in flight
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = repositoriesService.Repositories(ctx, models.NewRepositoriesRequest(models.WithCount(3)))
+	require.NotNil(t, err)
+
+	close(release)
+
+	// the probe carries on and decides for the next request
+	_, err = repositoriesService.Repositories(context.TODO(), models.NewRepositoriesRequest(models.WithCount(3)))
+	require.Nil(t, err)
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&probes))
+
+	testService.AssertCalls(t, 1)
+}
+
+func TestRepositoriesInvalidID(t *testing.T) {
+	repositoriesService, err := New("http://localhost")
+	require.Nil(t, err)
+
+	_, err = repositoriesService.Repositories(context.TODO(), models.NewRepositoriesRequest(models.WithIDs(1, 0)))
+	assert.True(t, errors.Is(err, models.ErrInvalidRequest))
+}
+
+type statusRecorder struct {
+	mu       sync.Mutex
+	statuses []int
+}
+
+func (r *statusRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err == nil {
+		r.mu.Lock()
+		r.statuses = append(r.statuses, resp.StatusCode)
+		r.mu.Unlock()
+	}
+
+	return resp, err
+}
+
+func TestRepositoriesRevalidation(t *testing.T) {
+	var (
+		recorder                 = &statusRecorder{}
+		testService              = codehost.New(codehost.WithBehaviour(codehost.Behaviour{}), codehost.WithoutBatch)
+		testServer               = httptest.NewServer(testService)
+		repositoriesService, err = New(testServer.URL, WithClient(&http.Client{Transport: recorder}))
+		req                      = models.NewRepositoriesRequest(models.WithIDs(2))
+	)
+
+	defer testServer.Close()
+
+	require.Nil(t, err)
+
+	first, err := repositoriesService.Repositories(context.TODO(), req)
+	require.Nil(t, err)
+
+	second, err := repositoriesService.Repositories(context.TODO(), req)
+	require.Nil(t, err)
+
+	assert.Equal(t, first[0].ETag, second[0].ETag)
+	assert.True(t, second[0].FetchedAt.After(first[0].FetchedAt))
+
+	_, ok := testService.RenameRepository(2, "renamed")
+	require.True(t, ok)
+
+	third, err := repositoriesService.Repositories(context.TODO(), req)
+	require.Nil(t, err)
+
+	assert.Equal(t, "renamed", third[0].Name)
+	assert.NotEqual(t, first[0].ETag, third[0].ETag)
+
+	// the probe for batch support is followed by one call per request
+	assert.Equal(t, []int{http.StatusNotFound, http.StatusOK, http.StatusNotModified, http.StatusOK}, recorder.statuses)
+}
+
+func TestRepositoriesCredentials(t *testing.T) {
+	var (
+		testService = codehost.New(
+			codehost.WithBehaviour(codehost.Behaviour{}),
+			codehost.WithTokens(codehost.Token{Value: "limited", Quota: 1}, codehost.Token{Value: "unlimited"}),
+		)
+		testServer               = httptest.NewServer(testService)
+		repositoriesService, err = New(testServer.URL, WithTokens("invalid", "limited", "unlimited"))
+	)
+
+	defer testServer.Close()
+
+	require.Nil(t, err)
+
+	resp, err := repositoriesService.Repositories(context.TODO(), models.NewRepositoriesRequest(models.WithCount(2)))
+	require.Nil(t, err)
+	assert.Len(t, resp, 2)
+
+	token, _ := repositoriesService.credentials.token()
+	assert.Equal(t, "[redacted] [redacted] [redacted]", fmt.Sprintf("%v %s %#v", token, token, token))
+}
+
+func TestRepositoriesProfiles(t *testing.T) {
+	var (
+		testService              = codehost.New(codehost.WithBehaviour(codehost.Behaviour{}), codehost.WithoutBatch)
+		testServer               = httptest.NewServer(testService)
+		repositoriesService, err = New(testServer.URL+"?errorRatio=1", WithProfiles(map[string]Profile{
+			"healthy": {Query: map[string]string{"errorRatio": "0"}},
+			"calm":    {Query: map[string]string{"latency": "0s"}},
+		}))
+	)
+
+	defer testServer.Close()
+
+	require.Nil(t, err)
+
+	for _, testCase := range []struct {
+		Name          string
+		Request       models.RepositoriesRequest
+		ExpectedError error
+	}{
+		{
+			Name:          "default profile from address",
+			Request:       models.NewRepositoriesRequest(),
+			ExpectedError: statusError{code: http.StatusInternalServerError},
+		},
+		{
+			Name:    "named profile",
+			Request: models.NewRepositoriesRequest(models.WithUpstreamProfile("healthy")),
+		},
+		{
+			Name:    "named profile replaces the address query",
+			Request: models.NewRepositoriesRequest(models.WithUpstreamProfile("calm")),
+		},
+		{
+			Name:    "upstream params override profile",
+			Request: models.NewRepositoriesRequest(models.WithUpstreamParams(url.Values{"errorRatio": {"0"}})),
+		},
+		{
+			Name:          "unknown profile",
+			Request:       models.NewRepositoriesRequest(models.WithUpstreamProfile("missing")),
+			ExpectedError: fmt.Errorf("%w: unknown upstream profile %q", models.ErrInvalidRequest, "missing"),
+		},
+	} {
+		t.Run(testCase.Name, func(t *testing.T) {
+			resp, err := repositoriesService.Repositories(context.TODO(), testCase.Request)
+			assert.Equal(t, testCase.ExpectedError, err)
+
+			if testCase.ExpectedError == nil {
+				assert.Len(t, resp, 1)
+			}
+		})
+	}
+
+	assert.Equal(t, 1, testService.Stats().Failures["error"])
+
+	// a configured default profile replaces the address query too
+	repositoriesService, err = New(testServer.URL+"?errorRatio=1", WithProfiles(map[string]Profile{
+		DefaultProfile: {Query: map[string]string{"latency": "0s"}},
+	}))
+	require.Nil(t, err)
+
+	_, err = repositoriesService.Repositories(context.TODO(), models.NewRepositoriesRequest())
+	assert.Nil(t, err)
+}
+
+func TestRepositoriesUpstreams(t *testing.T) {
+	for _, testCase := range []struct {
+		Name string
+		// whether each upstream always fails
+		Failing []bool
+		Options []Option
+		// expectations
+		ExpectedErrors int
+		// calls to /repository, after the probe for batch support
+		// has taken the first turn
+		ExpectedCalls []int
+	}{
+		{
+			Name:          "round robin",
+			Failing:       []bool{false, false},
+			ExpectedCalls: []int{2, 2},
+		},
+		{
+			Name:          "least outstanding",
+			Failing:       []bool{false, false, false},
+			Options:       []Option{WithBalancing(LeastOutstanding)},
+			ExpectedCalls: []int{1, 2, 1},
+		},
+		{
+			Name:          "failover and ejection",
+			Failing:       []bool{true, false},
+			Options:       []Option{WithEjection(1, time.Minute)},
+			ExpectedCalls: []int{1, 4},
+		},
+		{
+			Name:          "failover without ejection",
+			Failing:       []bool{true, false},
+			Options:       []Option{WithEjection(0, 0)},
+			ExpectedCalls: []int{3, 4},
+		},
+		{
+			Name:           "single attempt",
+			Failing:        []bool{true, false},
+			Options:        []Option{WithMaxAttempts(1), WithEjection(0, 0)},
+			ExpectedErrors: 2,
+			ExpectedCalls:  []int{2, 2},
+		},
+	} {
+		t.Run(testCase.Name, func(t *testing.T) {
+			var (
+				services  []*codehost.Server
+				addresses []string
+			)
+
+			for _, failing := range testCase.Failing {
+				behaviour := codehost.Behaviour{}
+				if failing {
+					behaviour.ErrorRatio = 1
+				}
+
+				service := codehost.New(codehost.WithBehaviour(behaviour), codehost.WithoutBatch)
+				server := httptest.NewServer(service)
+				defer server.Close()
+
+				services = append(services, service)
+				addresses = append(addresses, server.URL)
+			}
+
+			opts := append([]Option{WithUpstreams(addresses[1:]...)}, testCase.Options...)
+
+			repositoriesService, err := New(addresses[0], opts...)
+			require.Nil(t, err)
+
+			var errs int
+			for i := 0; i < 4; i++ {
+				if _, err := repositoriesService.Repositories(context.TODO(), models.NewRepositoriesRequest()); err != nil {
+					errs++
+				}
+			}
+
+			assert.Equal(t, testCase.ExpectedErrors, errs)
+
+			var calls []int
+			for _, service := range services {
+				calls = append(calls, service.Stats().Calls)
+			}
+
+			assert.Equal(t, testCase.ExpectedCalls, calls)
+		})
+	}
+}
+
+func TestRepositoriesInheritHealth(t *testing.T) {
+	var (
+		failing       = codehost.New(codehost.WithBehaviour(codehost.Behaviour{ErrorRatio: 1}), codehost.WithoutBatch)
+		healthy       = codehost.New(codehost.WithBehaviour(codehost.Behaviour{}), codehost.WithoutBatch)
+		failingServer = httptest.NewServer(failing)
+		healthyServer = httptest.NewServer(healthy)
+		opts          = []Option{WithUpstreams(healthyServer.URL), WithEjection(1, time.Minute)}
+	)
+
+	defer failingServer.Close()
+	defer healthyServer.Close()
+
+	prev, err := New(failingServer.URL, opts...)
+	require.Nil(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, err := prev.Repositories(context.TODO(), models.NewRepositoriesRequest())
+		require.Nil(t, err)
+	}
+
+	// the failing upstream has been ejected
+	failing.AssertCalls(t, 1)
+
+	next, err := New(failingServer.URL, append(opts, Inherit(prev))...)
+	require.Nil(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, err := next.Repositories(context.TODO(), models.NewRepositoriesRequest())
+		require.Nil(t, err)
+	}
+
+	// and remains ejected once prev is replaced
+	failing.AssertCalls(t, 1)
+}
+
+func TestPoolPick(t *testing.T) {
+	future := time.Now().Add(time.Hour)
+
+	for _, testCase := range []struct {
+		Name      string
+		Balancing Balancing
+		Backends  []backend
+		Tried     []int
+		Expected  int
+	}{
+		{
+			Name:      "round robin skips tried",
+			Balancing: RoundRobin,
+			Backends:  []backend{{}, {}, {}},
+			Tried:     []int{0},
+			Expected:  1,
+		},
+		{
+			Name:      "least outstanding",
+			Balancing: LeastOutstanding,
+			Backends:  []backend{{outstanding: 3}, {outstanding: 1}, {outstanding: 2}},
+			Expected:  1,
+		},
+		{
+			Name:      "latency weighted measures unmeasured",
+			Balancing: LatencyWeighted,
+			Backends:  []backend{{latency: time.Millisecond}, {}},
+			Expected:  1,
+		},
+		{
+			Name:      "ejected avoided",
+			Balancing: RoundRobin,
+			Backends:  []backend{{ejectedUntil: future}, {}},
+			Expected:  1,
+		},
+		{
+			Name:      "ejected used as last resort",
+			Balancing: RoundRobin,
+			Backends:  []backend{{ejectedUntil: future}, {}},
+			Tried:     []int{1},
+			Expected:  0,
+		},
+		{
+			Name:      "all tried",
+			Balancing: RoundRobin,
+			Backends:  []backend{{}, {}},
+			Tried:     []int{0, 1},
+			Expected:  -1,
+		},
+	} {
+		t.Run(testCase.Name, func(t *testing.T) {
+			var (
+				backends = make([]*backend, len(testCase.Backends))
+				tried    = map[*backend]bool{}
+			)
+
+			for i := range testCase.Backends {
+				backends[i] = &testCase.Backends[i]
+			}
+
+			for _, i := range testCase.Tried {
+				tried[backends[i]] = true
+			}
+
+			p := newPool(backends...)
+			p.balancing = testCase.Balancing
+
+			picked := p.pick(tried)
+			if testCase.Expected < 0 {
+				assert.Nil(t, picked)
+				return
+			}
+
+			assert.Equal(t, backends[testCase.Expected], picked)
+		})
+	}
+}
+
+func TestLoadUpstreams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upstreams")
+	require.Nil(t, err)
+
+	defer os.RemoveAll(dir)
+
+	for _, testCase := range []struct {
+		Name              string
+		Contents          string
+		ExpectedAddresses []string
+	}{
+		{
+			Name:              "lines",
+			Contents:          "# replicas\nhttp://a:7080\n\n  http://b:7080  \n",
+			ExpectedAddresses: []string{"http://a:7080", "http://b:7080"},
+		},
+		{
+			Name:              "json",
+			Contents:          ` ["http://a:7080", "http://b:7080"]`,
+			ExpectedAddresses: []string{"http://a:7080", "http://b:7080"},
+		},
+	} {
+		t.Run(testCase.Name, func(t *testing.T) {
+			path := filepath.Join(dir, testCase.Name)
+			require.Nil(t, ioutil.WriteFile(path, []byte(testCase.Contents), 0644))
+
+			addresses, err := LoadUpstreams(path)
+			require.Nil(t, err)
+
+			assert.Equal(t, testCase.ExpectedAddresses, addresses)
+		})
+	}
+}
+
+func TestLoadTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	require.Nil(t, ioutil.WriteFile(path, []byte("# rotated monthly\nfirst\n\n  second:100  \n"), 0644))
+
+	tokens, err := LoadTokens(path)
+	require.Nil(t, err)
+
+	// quotas are only understood by the code host
+	assert.Equal(t, []string{"first", "second:100"}, tokens)
+}
+
+func TestWatchUpstreams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upstreams")
+	require.Nil(t, err)
+
+	defer os.RemoveAll(dir)
+
+	var (
+		before, after = codehost.New(codehost.WithBehaviour(codehost.Behaviour{})), codehost.New(codehost.WithBehaviour(codehost.Behaviour{}))
+		beforeServer  = httptest.NewServer(before)
+		afterServer   = httptest.NewServer(after)
+		path          = filepath.Join(dir, "upstreams")
+	)
+
+	defer beforeServer.Close()
+	defer afterServer.Close()
+
+	require.Nil(t, ioutil.WriteFile(path, []byte(beforeServer.URL+"\n"), 0644))
+
+	addresses, err := LoadUpstreams(path)
+	require.Nil(t, err)
+
+	repositoriesService, err := New(addresses[0])
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go repositoriesService.WatchUpstreams(ctx, path, 10*time.Millisecond, func(err error) {
+		t.Error(err)
+	})
+
+	_, err = repositoriesService.Repositories(ctx, models.NewRepositoriesRequest())
+	require.Nil(t, err)
+
+	require.Nil(t, ioutil.WriteFile(path, []byte(`["`+afterServer.URL+`"]`), 0644))
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if repositoriesService.Upstreams()[0] == afterServer.URL {
+			break
+		}
+	}
+
+	require.Equal(t, []string{afterServer.URL}, repositoriesService.Upstreams())
+
+	_, err = repositoriesService.Repositories(ctx, models.NewRepositoriesRequest())
+	require.Nil(t, err)
+
+	assert.Equal(t, 1, before.Stats().Calls)
+	assert.Equal(t, 1, after.Stats().Calls)
+
+	assert.Equal(t, errNoUpstreams, repositoriesService.SetUpstreams(nil))
+}
+
+func TestRepositoriesInherit(t *testing.T) {
+	var (
+		recorder    = &statusRecorder{}
+		testService = codehost.New(codehost.WithBehaviour(codehost.Behaviour{}), codehost.WithoutBatch)
+		testServer  = httptest.NewServer(testService)
+		req         = models.NewRepositoriesRequest(models.WithIDs(2))
+	)
+
+	defer testServer.Close()
+
+	prev, err := New(testServer.URL, WithClient(&http.Client{Transport: recorder}))
+	require.Nil(t, err)
+
+	_, err = prev.Repositories(context.TODO(), req)
+	require.Nil(t, err)
+
+	next, err := New(testServer.URL, WithClient(&http.Client{Transport: recorder}), Inherit(prev))
+	require.Nil(t, err)
+
+	_, err = next.Repositories(context.TODO(), req)
+	require.Nil(t, err)
+
+	// batch support is not probed again and the cached repository is revalidated
+	assert.Equal(t, []int{http.StatusNotFound, http.StatusOK, http.StatusNotModified}, recorder.statuses)
+}
+
+func TestRepositoriesCacheOnly(t *testing.T) {
+	var (
+		testService              = codehost.New(codehost.WithBehaviour(codehost.Behaviour{}))
+		testServer               = httptest.NewServer(testService)
+		repositoriesService, err = New(testServer.URL)
+	)
+
+	defer testServer.Close()
+
+	require.Nil(t, err)
+
+	fetched, err := repositoriesService.Repositories(context.TODO(), models.NewRepositoriesRequest(models.WithIDs(1, 2), models.Stable))
+	require.Nil(t, err)
+
+	calls := testService.Stats().Calls
+
+	for _, testCase := range []struct {
+		Name          string
+		Request       models.RepositoriesRequest
+		ExpectedCount int
+	}{
+		{
+			Name:          "by ID",
+			Request:       models.NewRepositoriesRequest(models.WithIDs(1, 2, 3), models.CacheOnly, models.Stable),
+			ExpectedCount: 2,
+		},
+		{
+			Name:          "random",
+			Request:       models.NewRepositoriesRequest(models.WithCount(5), models.CacheOnly),
+			ExpectedCount: 5,
+		},
+		{
+			Name:          "random unique",
+			Request:       models.NewRepositoriesRequest(models.WithCount(5), models.CacheOnly, models.Unique, byID),
+			ExpectedCount: 2,
+		},
+	} {
+		t.Run(testCase.Name, func(t *testing.T) {
+			repos, err := repositoriesService.Repositories(context.TODO(), testCase.Request)
+			require.Nil(t, err)
+
+			assert.Len(t, repos, testCase.ExpectedCount)
+			if testCase.Request.Unique || len(testCase.Request.IDs) > 0 {
+				assert.Equal(t, fetched, repos)
+			}
+		})
+	}
+
+	assert.Equal(t, calls, testService.Stats().Calls)
+}
+
+func TestRepositoriesTimeout(t *testing.T) {
+	slow := codehost.Respond(repoC).After(300 * time.Millisecond)
+
+	for _, testCase := range []struct {
+		Name    string
+		Request models.RepositoriesRequest
+		// expectations
+		ExpectedCount        int
+		ExpectedRepositories []models.Repository
+	}{
+		{
+			Name:                 "unique backfilled with unseen repositories",
+			Request:              models.NewRepositoriesRequest(models.WithCount(3), models.Unique, models.WithTimeout(50*time.Millisecond), byID),
+			ExpectedCount:        2,
+			ExpectedRepositories: []models.Repository{repoA, repoB},
+		},
+		{
+			Name:          "backfilled with any repositories",
+			Request:       models.NewRepositoriesRequest(models.WithCount(3), models.WithTimeout(50*time.Millisecond)),
+			ExpectedCount: 3,
+		},
+	} {
+		t.Run(testCase.Name, func(t *testing.T) {
+			var (
+				testService = codehost.New(codehost.WithScript(
+					codehost.Respond(repoA), codehost.Respond(repoB),
+					codehost.Respond(repoA), slow, slow,
+				))
+				testServer               = httptest.NewServer(testService)
+				repositoriesService, err = New(testServer.URL)
+			)
+
+			defer testServer.Close()
+
+			require.Nil(t, err)
+
+			// warm the cache with repoA and repoB
+			_, err = repositoriesService.Repositories(context.TODO(), models.NewRepositoriesRequest(models.WithCount(2), models.Unique))
+			require.Nil(t, err)
+
+			repos, err := repositoriesService.Repositories(context.TODO(), testCase.Request)
+			require.Nil(t, err)
+
+			assert.Len(t, repos, testCase.ExpectedCount)
+			if testCase.ExpectedRepositories != nil {
+				assert.Equal(t, testCase.ExpectedRepositories, repos)
+			}
+		})
+	}
+}
+
+func TestStreamRepositoriesNothingCollected(t *testing.T) {
+	slow := codehost.Respond(repoC).After(300 * time.Millisecond)
+
+	for _, testCase := range []struct {
+		Name    string
+		Request models.RepositoriesRequest
+	}{
+		{
+			Name:    "no repositories requested",
+			Request: models.NewRepositoriesRequest(models.WithCount(0)),
+		},
+		{
+			Name:    "timed out with nothing cached",
+			Request: models.NewRepositoriesRequest(models.WithCount(3), models.WithTimeout(50*time.Millisecond)),
+		},
+	} {
+		t.Run(testCase.Name, func(t *testing.T) {
+			var (
+				testService              = codehost.New(codehost.WithScript(slow), codehost.Loop, codehost.WithoutBatch)
+				testServer               = httptest.NewServer(testService)
+				repositoriesService, err = New(testServer.URL)
+			)
+
+			defer testServer.Close()
+
+			require.Nil(t, err)
+
+			var events []models.Event
+
+			err = repositoriesService.StreamRepositories(context.TODO(), testCase.Request, func(ev models.Event) error {
+				events = append(events, ev)
+				return nil
+			})
+			require.Nil(t, err)
+
+			// neither is an empty repository collected into any slot
+			assert.Empty(t, events)
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/georgemac/repositories/pkg/models"
+)
+
+// APIKeyHeader is the header in which clients present an API key.
+const APIKeyHeader = "X-API-Key"
+
+// ErrNoCredentials is returned by an Authenticator
+// when a request does not present its credentials.
+var ErrNoCredentials = errors.New("no credentials presented")
+
+// Principal is the authenticated client making a request.
+type Principal struct {
+	Name   string `json:"name"`
+	Limits Limits `json:"limits"`
+}
+
+// Limits restricts the requests a principal may make.
+// The zero value is unrestricted.
+type Limits struct {
+	// MaxCount limits the number of repositories requested, unless it is zero.
+	MaxCount      int  `json:"maxCount,omitempty"`
+	DenyUnique    bool `json:"denyUnique,omitempty"`
+	DenyCacheOnly bool `json:"denyCacheOnly,omitempty"`
+}
+
+// permit returns an error describing why req exceeds l, if it does.
+func (l Limits) permit(req models.RepositoriesRequest) error {
+	switch {
+	case l.MaxCount > 0 && req.Count > l.MaxCount:
+		return fmt.Errorf("count must not exceed %d", l.MaxCount)
+	case l.DenyUnique && req.Unique:
+		return errors.New("unique requests are not permitted")
+	case l.DenyCacheOnly && req.CacheOnly:
+		return errors.New("cache only requests are not permitted")
+	}
+
+	return nil
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying p.
+func WithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFromContext returns the principal carried by ctx, if any.
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// Authenticator identifies the principal making a request. It returns
+// ErrNoCredentials when the request does not present credentials it
+// understands, and any other error when they are invalid.
+type Authenticator interface {
+	Authenticate(*http.Request) (Principal, error)
+}
+
+// Authenticators tries each Authenticator in turn until
+// one finds credentials it understands.
+type Authenticators []Authenticator
+
+func (a Authenticators) Authenticate(r *http.Request) (Principal, error) {
+	for _, authenticator := range a {
+		p, err := authenticator.Authenticate(r)
+		if err != ErrNoCredentials {
+			return p, err
+		}
+	}
+
+	return Principal{}, ErrNoCredentials
+}
+
+// Authenticate responds 401 Unauthorized to requests which a does not
+// authenticate and serves the rest with next, the principal attached
+// to the context of the request.
+func Authenticate(a Authenticator, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := a.Authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="repositories"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		if entry := accessEntryFromContext(r.Context()); entry != nil {
+			entry.principal = p.Name
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), p)))
+	})
+}
+
+// APIKeys authenticates requests presenting a static key in the
+// X-API-Key header. Keys are held as digests so that looking one
+// up does not reveal how much of a presented key is correct.
+type APIKeys map[[sha256.Size]byte]Principal
+
+// NewAPIKeys returns APIKeys for the principals keyed by API key.
+func NewAPIKeys(keys map[string]Principal) APIKeys {
+	a := APIKeys{}
+	for key, p := range keys {
+		a[sha256.Sum256([]byte(key))] = p
+	}
+
+	return a
+}
+
+// LoadAPIKeys reads a JSON array of principals from path,
+// each with its key, e.g. [{"key": "...", "name": "ci", "limits": {"maxCount": 10}}].
+func LoadAPIKeys(path string) (APIKeys, error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer fi.Close()
+
+	var entries []struct {
+		Key string `json:"key"`
+		Principal
+	}
+
+	if err := json.NewDecoder(fi).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	keys := map[string]Principal{}
+	for i, entry := range entries {
+		if entry.Key == "" {
+			return nil, fmt.Errorf("%s: entry %d has no key", path, i)
+		}
+
+		if entry.Name == "" {
+			return nil, fmt.Errorf("%s: entry %d has no name", path, i)
+		}
+
+		keys[entry.Key] = entry.Principal
+	}
+
+	return NewAPIKeys(keys), nil
+}
+
+func (a APIKeys) Authenticate(r *http.Request) (Principal, error) {
+	key := strings.TrimSpace(r.Header.Get(APIKeyHeader))
+	if key == "" {
+		return Principal{}, ErrNoCredentials
+	}
+
+	p, ok := a[sha256.Sum256([]byte(key))]
+	if !ok {
+		return Principal{}, errors.New("invalid API key")
+	}
+
+	return p, nil
+}
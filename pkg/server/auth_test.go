@@ -0,0 +1,208 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/georgemac/repositories/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingService returns as many repositories as are requested.
+type countingService struct{}
+
+func (countingService) Repositories(ctx context.Context, req models.RepositoriesRequest) ([]models.Repository, error) {
+	repos := make([]models.Repository, req.Count)
+	for i := range repos {
+		repos[i].ID = i + 1
+	}
+
+	return repos, nil
+}
+
+var (
+	hmacSecret = []byte("secret")
+	rsaKey, _  = rsa.GenerateKey(rand.Reader, 2048)
+)
+
+// sign returns a token signed with alg carrying claims.
+func sign(t *testing.T, alg string, claims map[string]interface{}) string {
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		require.Nil(t, err)
+
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	signed := encode(map[string]string{"alg": alg, "typ": "JWT"}) + "." + encode(claims)
+
+	var signature []byte
+	switch alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, hmacSecret)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case "RS256":
+		digest := sha256.Sum256([]byte(signed))
+
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+		require.Nil(t, err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestAuthenticate(t *testing.T) {
+	var (
+		expiry = time.Now().Add(time.Hour).Unix()
+		claims = func(extra map[string]interface{}) map[string]interface{} {
+			c := map[string]interface{}{"sub": "ci", "iss": "issuer", "aud": []string{"repositories"}, "exp": expiry}
+			for k, v := range extra {
+				c[k] = v
+			}
+
+			return c
+		}
+
+		handler = Authenticate(Authenticators{
+			NewAPIKeys(map[string]Principal{
+				"unlimited": {Name: "unlimited"},
+				"limited":   {Name: "limited", Limits: Limits{MaxCount: 2, DenyUnique: true, DenyCacheOnly: true}},
+			}),
+			JWT{
+				Issuer:       "issuer",
+				Audience:     "repositories",
+				HMACSecret:   hmacSecret,
+				RSAPublicKey: &rsaKey.PublicKey,
+			},
+		}, New(countingService{}))
+	)
+
+	for _, testCase := range []struct {
+		Name   string
+		Query  string
+		APIKey string
+		Token  string
+		// expectations
+		ExpectedStatus int
+	}{
+		{
+			Name:           "no credentials",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Name:           "API key",
+			APIKey:         "unlimited",
+			Query:          "count=3&unique=true&cacheOnly=true",
+			ExpectedStatus: http.StatusOK,
+		},
+		{
+			Name:           "invalid API key",
+			APIKey:         "unknown",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Name:           "within limits",
+			APIKey:         "limited",
+			Query:          "count=2",
+			ExpectedStatus: http.StatusOK,
+		},
+		{
+			Name:           "count exceeds limit",
+			APIKey:         "limited",
+			Query:          "count=3",
+			ExpectedStatus: http.StatusForbidden,
+		},
+		{
+			Name:           "unique denied",
+			APIKey:         "limited",
+			Query:          "unique=true",
+			ExpectedStatus: http.StatusForbidden,
+		},
+		{
+			Name:           "cache only denied",
+			APIKey:         "limited",
+			Query:          "cacheOnly=true",
+			ExpectedStatus: http.StatusForbidden,
+		},
+		{
+			Name:           "HS256",
+			Token:          sign(t, "HS256", claims(nil)),
+			ExpectedStatus: http.StatusOK,
+		},
+		{
+			Name:           "RS256",
+			Token:          sign(t, "RS256", claims(map[string]interface{}{"aud": "repositories"})),
+			ExpectedStatus: http.StatusOK,
+		},
+		{
+			Name:           "limits claim",
+			Token:          sign(t, "HS256", claims(map[string]interface{}{"limits": Limits{MaxCount: 1}})),
+			Query:          "count=2",
+			ExpectedStatus: http.StatusForbidden,
+		},
+		{
+			Name:           "tampered",
+			Token:          sign(t, "HS256", claims(nil)) + "x",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Name:           "unsigned",
+			Token:          sign(t, "none", claims(nil)),
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Name:           "expired",
+			Token:          sign(t, "HS256", claims(map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()})),
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Name:           "no expiry",
+			Token:          sign(t, "HS256", claims(map[string]interface{}{"exp": nil})),
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Name:           "not yet valid",
+			Token:          sign(t, "HS256", claims(map[string]interface{}{"nbf": time.Now().Add(time.Minute).Unix()})),
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Name:           "wrong issuer",
+			Token:          sign(t, "HS256", claims(map[string]interface{}{"iss": "other"})),
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Name:           "wrong audience",
+			Token:          sign(t, "HS256", claims(map[string]interface{}{"aud": "other"})),
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+	} {
+		t.Run(testCase.Name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/repositories?"+testCase.Query, nil)
+			if testCase.APIKey != "" {
+				req.Header.Set(APIKeyHeader, testCase.APIKey)
+			}
+
+			if testCase.Token != "" {
+				req.Header.Set("Authorization", "Bearer "+testCase.Token)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, testCase.ExpectedStatus, rec.Code, rec.Body.String())
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// JWT authenticates requests presenting a JSON Web Token signed with
+// HS256 or RS256 as a bearer token. The subject of the token names the
+// principal and its limits are read from the limits claim, e.g.
+// {"sub": "ci", "limits": {"maxCount": 10}}.
+type JWT struct {
+	// Issuer and Audience, when set, must match the iss and aud claims.
+	Issuer   string
+	Audience string
+	// HMACSecret verifies HS256 tokens and RSAPublicKey RS256 tokens.
+	// Tokens signed with an algorithm which has no key are rejected.
+	HMACSecret   []byte
+	RSAPublicKey *rsa.PublicKey
+	// Leeway allows for clock skew when checking exp and nbf.
+	Leeway time.Duration
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+}
+
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt *float64 `json:"exp"`
+	NotBefore *float64 `json:"nbf"`
+	Limits    Limits   `json:"limits"`
+}
+
+// audience is the aud claim, which is either a string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		return json.Unmarshal(data, (*[]string)(a))
+	}
+
+	var single string
+	if err := json.Unmarshal(data, &single); err != nil {
+		return err
+	}
+
+	*a = audience{single}
+
+	return nil
+}
+
+func (j JWT) Authenticate(r *http.Request) (Principal, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return Principal{}, ErrNoCredentials
+	}
+
+	claims, err := j.verify(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")))
+	if err != nil {
+		return Principal{}, fmt.Errorf("invalid token: %v", err)
+	}
+
+	return Principal{Name: claims.Subject, Limits: claims.Limits}, nil
+}
+
+// verify checks the signature and claims of token and returns its claims.
+func (j JWT) verify(token string) (jwtClaims, error) {
+	var claims jwtClaims
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("malformed")
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return claims, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, err
+	}
+
+	var (
+		signed = []byte(parts[0] + "." + parts[1])
+		digest = sha256.Sum256(signed)
+	)
+
+	switch {
+	case header.Algorithm == "HS256" && j.HMACSecret != nil:
+		mac := hmac.New(sha256.New, j.HMACSecret)
+		mac.Write(signed)
+
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return claims, errors.New("signature mismatch")
+		}
+	case header.Algorithm == "RS256" && j.RSAPublicKey != nil:
+		if err := rsa.VerifyPKCS1v15(j.RSAPublicKey, crypto.SHA256, digest[:], signature); err != nil {
+			return claims, errors.New("signature mismatch")
+		}
+	default:
+		return claims, fmt.Errorf("unsupported algorithm %q", header.Algorithm)
+	}
+
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return claims, err
+	}
+
+	now := time.Now()
+
+	switch {
+	case claims.Subject == "":
+		return claims, errors.New("no subject")
+	case claims.ExpiresAt == nil:
+		return claims, errors.New("no expiry")
+	case now.After(numericDate(*claims.ExpiresAt).Add(j.Leeway)):
+		return claims, errors.New("expired")
+	case claims.NotBefore != nil && now.Before(numericDate(*claims.NotBefore).Add(-j.Leeway)):
+		return claims, errors.New("not yet valid")
+	case j.Issuer != "" && claims.Issuer != j.Issuer:
+		return claims, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	case j.Audience != "" && !claims.Audience.contains(j.Audience):
+		return claims, errors.New("unexpected audience")
+	}
+
+	return claims, nil
+}
+
+func (a audience) contains(v string) bool {
+	for _, candidate := range a {
+		if candidate == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// numericDate converts seconds since the epoch to a time.
+func numericDate(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// LoadRSAPublicKey reads a PEM encoded RSA public key from path,
+// in either PKIX or PKCS #1 form.
+func LoadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA public key", path)
+	}
+
+	return rsaKey, nil
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/georgemac/repositories/pkg/logging"
+	"github.com/georgemac/repositories/pkg/models"
+)
+
+// accessEntry collects what is known about a request
+// as it is served for its access log line.
+type accessEntry struct {
+	request   *models.RepositoriesRequest
+	principal string
+}
+
+type accessEntryKey struct{}
+
+func accessEntryFromContext(ctx context.Context) *accessEntry {
+	e, _ := ctx.Value(accessEntryKey{}).(*accessEntry)
+	return e
+}
+
+// statusWriter records the status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush supports the streaming response modes.
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// LogRequests serves requests with next and writes an access log line for
+// each to logger. Requests are correlated as Server does, and the request
+// ID and trace ID are also carried by a logger attached to the context of
+// the request, so that the events logged while serving it can be
+// correlated with the upstream calls made.
+func LogRequests(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, id, trace := correlate(w, r)
+
+		var (
+			start    = time.Now()
+			entry    = &accessEntry{}
+			sw       = &statusWriter{ResponseWriter: w}
+			ctx      context.Context
+			counters *logging.Counters
+		)
+
+		ctx, counters = logging.WithCounters(r.Context())
+		ctx = logging.WithLogger(ctx, logger.With("requestID", id, "traceID", trace.TraceID))
+		ctx = context.WithValue(ctx, accessEntryKey{}, entry)
+
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+
+		attrs := []slog.Attr{
+			slog.String("requestID", id),
+			slog.String("traceID", trace.TraceID),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", sw.status),
+			slog.Duration("duration", time.Since(start)),
+		}
+
+		if entry.principal != "" {
+			attrs = append(attrs, slog.String("principal", entry.principal))
+		}
+
+		if req := entry.request; req != nil {
+			attrs = append(attrs, slog.Int("count", req.Count), slog.Bool("unique", req.Unique))
+		}
+
+		attrs = append(attrs, counters.Attrs()...)
+
+		logger.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+	})
+}
+
+// correlate returns r with a request ID and trace context attached to its
+// context, taken from the X-Request-ID and traceparent headers it was made
+// with or new ones when they are missing or invalid, and echoes the request
+// ID in the response. Requests which have already been correlated are
+// returned as they are.
+func correlate(w http.ResponseWriter, r *http.Request) (*http.Request, string, logging.Traceparent) {
+	if id := logging.RequestID(r.Context()); id != "" {
+		trace, _ := logging.TraceparentFromContext(r.Context())
+		return r, id, trace
+	}
+
+	var (
+		id    = requestID(r)
+		trace = traceparent(r)
+		ctx   = logging.WithTraceparent(logging.WithRequestID(r.Context(), id), trace)
+	)
+
+	w.Header().Set(logging.RequestIDHeader, id)
+
+	return r.WithContext(ctx), id, trace
+}
+
+// requestID returns the ID r was made with, or a new one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(logging.RequestIDHeader); logging.ValidRequestID(id) {
+		return id
+	}
+
+	return logging.NewRequestID()
+}
+
+// traceparent returns the trace context of the proxy's span serving r,
+// which continues the trace r was made in, along with its tracestate,
+// or starts a new one.
+func traceparent(r *http.Request) logging.Traceparent {
+	if tp, err := logging.ParseTraceparent(r.Header.Get(logging.TraceparentHeader)); err == nil {
+		tp = tp.Child()
+		tp.State = logging.ParseTracestate(r.Header)
+
+		return tp
+	}
+
+	return logging.NewTraceparent()
+}
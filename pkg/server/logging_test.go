@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/georgemac/repositories/pkg/codehost"
+	"github.com/georgemac/repositories/pkg/logging"
+	"github.com/georgemac/repositories/pkg/models"
+	"github.com/georgemac/repositories/pkg/repositories"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogRequests(t *testing.T) {
+	var (
+		foo = models.Repository{ID: 1, Name: "foo"}
+		bar = models.Repository{ID: 2, Name: "bar"}
+
+		testService = codehost.New(codehost.WithScript(
+			codehost.Respond(foo),
+			codehost.Respond(foo),
+			codehost.Respond(bar),
+		))
+		testServer = httptest.NewServer(testService)
+		buf        bytes.Buffer
+		logger     = logging.New(&buf, logging.JSON, slog.LevelDebug)
+	)
+
+	defer testServer.Close()
+
+	service, err := repositories.New(testServer.URL)
+	require.Nil(t, err)
+
+	handler := LogRequests(logger, New(service))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/repositories?count=2&unique=true", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var records []map[string]interface{}
+	for dec := json.NewDecoder(&buf); dec.More(); {
+		var record map[string]interface{}
+		require.Nil(t, dec.Decode(&record))
+
+		records = append(records, record)
+	}
+
+	require.NotEmpty(t, records)
+
+	access := records[len(records)-1]
+	assert.Equal(t, "request", access["msg"])
+	assert.Equal(t, float64(http.StatusOK), access["status"])
+	assert.Equal(t, float64(2), access["count"])
+	assert.Equal(t, true, access["unique"])
+	// the probe for batch support and a batch per repository
+	assert.Equal(t, float64(4), access["attempts"])
+	assert.Equal(t, float64(1), access["duplicates"])
+
+	var messages []string
+	for _, record := range records {
+		assert.Equal(t, access["requestID"], record["requestID"])
+		messages = append(messages, record["msg"].(string))
+	}
+
+	assert.Contains(t, messages, "duplicate rejected")
+	assert.Contains(t, messages, "upstream call")
+}
+
+func TestLogRequestsTraceContext(t *testing.T) {
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	for _, testCase := range []struct {
+		Name string
+		// headers the request is made with
+		Header http.Header
+		// whether the server is wrapped in LogRequests
+		WithoutLogging bool
+		// expectations
+		ExpectedRequestID  string
+		ExpectedTraceID    string
+		ExpectedTracestate string
+	}{
+		{
+			Name: "generated",
+		},
+		{
+			Name: "accepted",
+			Header: http.Header{
+				logging.RequestIDHeader:   {"client-request-1"},
+				logging.TraceparentHeader: {traceparent},
+				logging.TracestateHeader:  {"vendor=a", "other=b"},
+			},
+			ExpectedRequestID:  "client-request-1",
+			ExpectedTraceID:    "4bf92f3577b34da6a3ce929d0e0e4736",
+			ExpectedTracestate: "vendor=a,other=b",
+		},
+		{
+			Name: "invalid",
+			Header: http.Header{
+				logging.RequestIDHeader:   {"client request\n1"},
+				logging.TraceparentHeader: {"00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+				logging.TracestateHeader:  {"vendor=a"},
+			},
+		},
+		{
+			Name: "accepted without logging",
+			Header: http.Header{
+				logging.RequestIDHeader:   {"client-request-1"},
+				logging.TraceparentHeader: {traceparent},
+			},
+			WithoutLogging:    true,
+			ExpectedRequestID: "client-request-1",
+			ExpectedTraceID:   "4bf92f3577b34da6a3ce929d0e0e4736",
+		},
+	} {
+		t.Run(testCase.Name, func(t *testing.T) {
+			var (
+				mu       sync.Mutex
+				received []http.Header
+
+				testService = codehost.New(codehost.WithBehaviour(codehost.Behaviour{}), codehost.WithScript(
+					codehost.Respond(models.Repository{ID: 1, Name: "foo"}),
+				))
+				testServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					mu.Lock()
+					received = append(received, r.Header.Clone())
+					mu.Unlock()
+
+					testService.ServeHTTP(w, r)
+				}))
+			)
+
+			defer testServer.Close()
+
+			service, err := repositories.New(testServer.URL)
+			require.Nil(t, err)
+
+			var handler http.Handler = New(service)
+			if !testCase.WithoutLogging {
+				handler = LogRequests(logging.New(ioutil.Discard, logging.JSON, slog.LevelInfo), handler)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/repositories?count=1", nil)
+			for k, values := range testCase.Header {
+				for _, v := range values {
+					req.Header.Add(k, v)
+				}
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			require.Equal(t, http.StatusOK, rec.Code)
+
+			id := rec.Header().Get(logging.RequestIDHeader)
+			require.NotEmpty(t, id)
+
+			if testCase.ExpectedRequestID != "" {
+				assert.Equal(t, testCase.ExpectedRequestID, id)
+			} else {
+				assert.True(t, logging.ValidRequestID(id))
+			}
+
+			require.NotEmpty(t, received)
+
+			for _, header := range received {
+				assert.Equal(t, id, header.Get(logging.RequestIDHeader))
+				assert.Equal(t, testCase.ExpectedTracestate, header.Get(logging.TracestateHeader))
+
+				tp, err := logging.ParseTraceparent(header.Get(logging.TraceparentHeader))
+				require.Nil(t, err)
+
+				if testCase.ExpectedTraceID != "" {
+					assert.Equal(t, testCase.ExpectedTraceID, tp.TraceID)
+					assert.NotEqual(t, "00f067aa0ba902b7", tp.ParentID)
+					assert.Equal(t, "01", tp.Flags)
+				} else {
+					assert.NotEqual(t, "4bf92f3577b34da6a3ce929d0e0e4736", tp.TraceID)
+				}
+			}
+		})
+	}
+}
@@ -2,10 +2,20 @@ package server
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/georgemac/repositories/pkg/logging"
 	"github.com/georgemac/repositories/pkg/models"
 )
 
@@ -13,43 +23,281 @@ type RepositoriesService interface {
 	Repositories(context.Context, models.RepositoriesRequest) ([]models.Repository, error)
 }
 
+// RepositoriesStreamer is implemented by services which can report
+// repositories as they are collected. It is required to serve the
+// streaming response modes.
+type RepositoriesStreamer interface {
+	StreamRepositories(context.Context, models.RepositoriesRequest, func(models.Event) error) error
+}
+
+const (
+	contentTypeJSON   = "application/json"
+	contentTypeNDJSON = "application/x-ndjson"
+	contentTypeEvents = "text/event-stream"
+)
+
+// upstreamPrefix prefixes query parameters which are forwarded
+// to the repository service, e.g. upstream.latency=1s.
+const upstreamPrefix = "upstream."
+
+// Server serves /repositories. Every request is identified by the
+// X-Request-ID and traceparent headers it was made with, or new ones,
+// which are forwarded on the calls made to the repository service and
+// the request ID is echoed in the response.
 type Server struct {
 	RepositoriesService RepositoriesService
+	// TrustUpstream reports whether a request may pass upstream.*
+	// parameters through to the repository service. Requests with
+	// upstream parameters are forbidden when it is nil.
+	TrustUpstream func(*http.Request) bool
+	// MaxCount limits the number of repositories
+	// a request may ask for, unless it is zero.
+	MaxCount int
 }
 
 func New(s RepositoriesService) *Server {
-	return &Server{s}
+	return &Server{RepositoriesService: s}
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r, _, _ = correlate(w, r)
+
 	if r.Method != "GET" {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	req, err := parseRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if entry := accessEntryFromContext(r.Context()); entry != nil {
+		entry.request = &req
+	}
+
+	if s.MaxCount > 0 && req.Count > s.MaxCount {
+		http.Error(w, fmt.Sprintf("count must not exceed %d", s.MaxCount), http.StatusBadRequest)
+		return
+	}
+
+	if p, ok := PrincipalFromContext(r.Context()); ok {
+		if err := p.Limits.permit(req); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	if req.UpstreamProfile != "" || len(req.UpstreamParams) > 0 {
+		if s.TrustUpstream == nil || !s.TrustUpstream(r) {
+			http.Error(w, "upstream parameters not permitted", http.StatusForbidden)
+			return
+		}
+	}
+
+	if contentType := negotiate(r); contentType != contentTypeJSON {
+		// repositories are streamed as they are collected, so
+		// cannot be put in any order other than their arrival
+		if req.Stable || req.Sort != (models.Sort{}) {
+			http.Error(w, "sort and stable are not supported when streaming", http.StatusBadRequest)
+			return
+		}
+
+		streamer, ok := s.RepositoriesService.(RepositoriesStreamer)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusNotAcceptable)
+			return
+		}
+
+		if contentType == contentTypeNDJSON {
+			serveNDJSON(w, r, streamer, req)
+			return
+		}
+
+		serveEvents(w, r, streamer, req)
+		return
+	}
+
+	resp, err := s.RepositoriesService.Repositories(r.Context(), req)
+	if err != nil {
+		logging.FromContext(r.Context()).WarnContext(r.Context(), "fetching repositories failed", "error", err)
+
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	// responses for specific IDs are deterministic so can be validated
+	if etag := responseETag(req, resp); etag != "" {
+		w.Header().Set("ETag", etag)
+
+		if matchETag(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", contentTypeJSON)
+
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func parseRequest(r *http.Request) (models.RepositoriesRequest, error) {
 	req := models.NewRepositoriesRequest()
 
 	if v := r.URL.Query().Get("count"); v != "" {
 		count, err := strconv.ParseInt(v, 10, 32)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+			return req, err
+		}
+
+		if count < 0 {
+			return req, errors.New("count must not be negative")
 		}
 
 		models.WithCount(int(count))(&req)
 	}
 
+	if v := r.URL.Query().Get("ids"); v != "" {
+		var ids []int
+		for _, id := range strings.Split(v, ",") {
+			i, err := strconv.Atoi(strings.TrimSpace(id))
+			if err != nil {
+				return req, err
+			}
+
+			if i <= 0 {
+				return req, fmt.Errorf("invalid id %d: ids must be positive", i)
+			}
+
+			ids = append(ids, i)
+		}
+
+		if r.URL.Query().Get("count") != "" && req.Count != len(ids) {
+			return req, errors.New("count does not match number of ids")
+		}
+
+		models.WithIDs(ids...)(&req)
+	}
+
 	if v := r.URL.Query().Get("unique"); v == "true" {
 		models.Unique(&req)
 	}
 
-	resp, err := s.RepositoriesService.Repositories(r.Context(), req)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if v := r.URL.Query().Get("stable"); v == "true" {
+		models.Stable(&req)
 	}
 
-	if err := json.NewEncoder(w).Encode(&resp); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if v := r.URL.Query().Get("cacheOnly"); v == "true" {
+		models.CacheOnly(&req)
+	}
+
+	if v := r.URL.Query().Get("sort"); v != "" {
+		sort, err := models.ParseSort(v)
+		if err != nil {
+			return req, err
+		}
+
+		models.SortBy(sort)(&req)
+	}
+
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			return req, err
+		}
+
+		models.WithTimeout(timeout)(&req)
+	}
+
+	for key, values := range r.URL.Query() {
+		if !strings.HasPrefix(key, upstreamPrefix) {
+			continue
+		}
+
+		param := strings.TrimPrefix(key, upstreamPrefix)
+		if param == "profile" {
+			models.WithUpstreamProfile(values[0])(&req)
+			continue
+		}
+
+		if req.UpstreamParams == nil {
+			req.UpstreamParams = url.Values{}
+		}
+
+		req.UpstreamParams[param] = values
 	}
+
+	return req, nil
+}
+
+// errorStatus returns the status code of the response to err.
+func errorStatus(err error) int {
+	if errors.Is(err, models.ErrInvalidRequest) {
+		return http.StatusBadRequest
+	}
+
+	return http.StatusInternalServerError
+}
+
+// responseETag returns a weak entity tag derived from the entity tags of
+// the repositories in a response for specific IDs. It is weak as the
+// fetchedAt of each repository changes even when it has not been modified.
+// An empty string is returned if the response cannot be validated.
+func responseETag(req models.RepositoriesRequest, repos []models.Repository) string {
+	if len(req.IDs) == 0 || len(repos) == 0 {
+		return ""
+	}
+
+	// sort as the order of unstable responses varies
+	tags := make([]string, 0, len(repos))
+	for _, repo := range repos {
+		if repo.ETag == "" {
+			return ""
+		}
+
+		tags = append(tags, fmt.Sprintf("%d:%s", repo.ID, repo.ETag))
+	}
+
+	sort.Strings(tags)
+
+	h := sha1.New()
+	for _, tag := range tags {
+		fmt.Fprintln(h, tag)
+	}
+
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:8]) + `"`
+}
+
+// matchETag reports whether the If-None-Match header
+// value ifNoneMatch weakly matches etag.
+func matchETag(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// negotiate returns the first supported content type listed
+// in the Accept header, defaulting to JSON.
+func negotiate(r *http.Request) string {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+
+		switch mediaType {
+		case contentTypeJSON, contentTypeNDJSON, contentTypeEvents:
+			return mediaType
+		}
+	}
+
+	return contentTypeJSON
 }
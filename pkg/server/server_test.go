@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/georgemac/repositories/pkg/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// streamingService emits events and then fails with err, if set.
+type streamingService struct {
+	events []models.Event
+	err    error
+}
+
+func (s streamingService) Repositories(ctx context.Context, req models.RepositoriesRequest) (repos []models.Repository, err error) {
+	err = s.StreamRepositories(ctx, req, func(ev models.Event) error {
+		if ev.Type == models.EventRepository {
+			repos = append(repos, ev.Repository)
+		}
+
+		return nil
+	})
+
+	return
+}
+
+func (s streamingService) StreamRepositories(ctx context.Context, req models.RepositoriesRequest, fn func(models.Event) error) error {
+	for _, ev := range s.events {
+		if err := fn(ev); err != nil {
+			return err
+		}
+	}
+
+	return s.err
+}
+
+func TestServerStreaming(t *testing.T) {
+	var (
+		foo    = models.Repository{ID: 1, Name: "foo"}
+		bar    = models.Repository{ID: 2, Name: "bar"}
+		events = []models.Event{
+			{Type: models.EventRepository, Slot: 0, Repository: foo},
+			{Type: models.EventRetry, Slot: 1, Repository: foo, Reason: "duplicate"},
+			{Type: models.EventRepository, Slot: 1, Repository: bar},
+		}
+		failure = errors.New("upstream failed")
+	)
+
+	for _, testCase := range []struct {
+		Name    string
+		Service RepositoriesService
+		Query   string
+		Accept  string
+		// expectations
+		ExpectedStatus      int
+		ExpectedContentType string
+		ExpectedBody        string
+	}{
+		{
+			Name:                "JSON by default",
+			Service:             streamingService{events: events},
+			ExpectedStatus:      http.StatusOK,
+			ExpectedContentType: contentTypeJSON,
+			ExpectedBody: `[{"id":1,"name":"foo","fetchedAt":"0001-01-01T00:00:00Z"},{"id":2,"name":"bar","fetchedAt":"0001-01-01T00:00:00Z"}]
+`,
+		},
+		{
+			Name:                "NDJSON",
+			Service:             streamingService{events: events},
+			Accept:              contentTypeNDJSON,
+			ExpectedStatus:      http.StatusOK,
+			ExpectedContentType: contentTypeNDJSON,
+			ExpectedBody: `{"id":1,"name":"foo","fetchedAt":"0001-01-01T00:00:00Z"}
+{"id":2,"name":"bar","fetchedAt":"0001-01-01T00:00:00Z"}
+`,
+		},
+		{
+			Name:                "first supported type accepted",
+			Service:             streamingService{events: events[:1]},
+			Accept:              "text/html, application/x-ndjson; q=0.9, application/json",
+			ExpectedStatus:      http.StatusOK,
+			ExpectedContentType: contentTypeNDJSON,
+			ExpectedBody: `{"id":1,"name":"foo","fetchedAt":"0001-01-01T00:00:00Z"}
+`,
+		},
+		{
+			Name:                "NDJSON error",
+			Service:             streamingService{events: events[:1], err: failure},
+			Accept:              contentTypeNDJSON,
+			ExpectedStatus:      http.StatusOK,
+			ExpectedContentType: contentTypeNDJSON,
+			ExpectedBody: `{"id":1,"name":"foo","fetchedAt":"0001-01-01T00:00:00Z"}
+{"error":"upstream failed"}
+`,
+		},
+		{
+			Name:                "events",
+			Service:             streamingService{events: events},
+			Accept:              contentTypeEvents,
+			ExpectedStatus:      http.StatusOK,
+			ExpectedContentType: contentTypeEvents,
+			ExpectedBody: `event: repository
+data: {"id":1,"name":"foo","fetchedAt":"0001-01-01T00:00:00Z"}
+
+event: progress
+data: {"received":1,"count":2}
+
+event: retry
+data: {"slot":1,"reason":"duplicate","repository":{"id":1,"name":"foo","fetchedAt":"0001-01-01T00:00:00Z"}}
+
+event: repository
+data: {"id":2,"name":"bar","fetchedAt":"0001-01-01T00:00:00Z"}
+
+event: progress
+data: {"received":2,"count":2}
+
+event: done
+data: {"received":2,"count":2}
+
+`,
+		},
+		{
+			Name:                "events error",
+			Service:             streamingService{events: events[:1], err: failure},
+			Accept:              contentTypeEvents,
+			ExpectedStatus:      http.StatusOK,
+			ExpectedContentType: contentTypeEvents,
+			ExpectedBody: `event: repository
+data: {"id":1,"name":"foo","fetchedAt":"0001-01-01T00:00:00Z"}
+
+event: progress
+data: {"received":1,"count":2}
+
+event: error
+data: {"error":"upstream failed"}
+
+`,
+		},
+		{
+			Name:           "streaming not supported",
+			Service:        countingService{},
+			Accept:         contentTypeEvents,
+			ExpectedStatus: http.StatusNotAcceptable,
+			ExpectedBody:   "streaming not supported\n",
+		},
+		{
+			Name:           "NDJSON sorted",
+			Service:        streamingService{events: events},
+			Query:          "&sort=name",
+			Accept:         contentTypeNDJSON,
+			ExpectedStatus: http.StatusBadRequest,
+			ExpectedBody:   "sort and stable are not supported when streaming\n",
+		},
+		{
+			Name:           "events stable",
+			Service:        streamingService{events: events},
+			Query:          "&stable=true",
+			Accept:         contentTypeEvents,
+			ExpectedStatus: http.StatusBadRequest,
+			ExpectedBody:   "sort and stable are not supported when streaming\n",
+		},
+	} {
+		t.Run(testCase.Name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/repositories?count=2"+testCase.Query, nil)
+			if testCase.Accept != "" {
+				req.Header.Set("Accept", testCase.Accept)
+			}
+
+			rec := httptest.NewRecorder()
+			New(testCase.Service).ServeHTTP(rec, req)
+
+			assert.Equal(t, testCase.ExpectedStatus, rec.Code)
+			if testCase.ExpectedContentType != "" {
+				assert.Equal(t, testCase.ExpectedContentType, rec.Header().Get("Content-Type"))
+			}
+
+			assert.Equal(t, testCase.ExpectedBody, rec.Body.String())
+		})
+	}
+}
+
+func TestServerInvalidRequest(t *testing.T) {
+	for _, testCase := range []struct {
+		Name  string
+		Query string
+		// expectations
+		ExpectedStatus int
+	}{
+		{
+			Name:           "valid ids",
+			Query:          "ids=1,2",
+			ExpectedStatus: http.StatusOK,
+		},
+		{
+			Name:           "negative count",
+			Query:          "count=-1",
+			ExpectedStatus: http.StatusBadRequest,
+		},
+		{
+			Name:           "zero id",
+			Query:          "ids=1,0",
+			ExpectedStatus: http.StatusBadRequest,
+		},
+		{
+			Name:           "negative id",
+			Query:          "ids=-3",
+			ExpectedStatus: http.StatusBadRequest,
+		},
+		{
+			Name:           "malformed id",
+			Query:          "ids=one",
+			ExpectedStatus: http.StatusBadRequest,
+		},
+		{
+			Name:           "count does not match ids",
+			Query:          "ids=1,2&count=3",
+			ExpectedStatus: http.StatusBadRequest,
+		},
+	} {
+		t.Run(testCase.Name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			New(countingService{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/repositories?"+testCase.Query, nil))
+
+			assert.Equal(t, testCase.ExpectedStatus, rec.Code)
+		})
+	}
+}
+
+func TestServerMaxCount(t *testing.T) {
+	for _, testCase := range []struct {
+		Name  string
+		Query string
+		// expectations
+		ExpectedStatus int
+	}{
+		{
+			Name:           "within the limit",
+			Query:          "count=2",
+			ExpectedStatus: http.StatusOK,
+		},
+		{
+			Name:           "beyond the limit",
+			Query:          "count=3",
+			ExpectedStatus: http.StatusBadRequest,
+		},
+	} {
+		t.Run(testCase.Name, func(t *testing.T) {
+			srv := New(countingService{})
+			srv.MaxCount = 2
+
+			rec := httptest.NewRecorder()
+			srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/repositories?"+testCase.Query, nil))
+
+			assert.Equal(t, testCase.ExpectedStatus, rec.Code)
+		})
+	}
+}
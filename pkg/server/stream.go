@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/georgemac/repositories/pkg/logging"
+	"github.com/georgemac/repositories/pkg/models"
+)
+
+// serveNDJSON writes each repository on its own line as soon as it
+// has been collected. Once the response has started errors can no
+// longer change the status code, so they are written as a final
+// {"error": "..."} line.
+func serveNDJSON(w http.ResponseWriter, r *http.Request, streamer RepositoriesStreamer, req models.RepositoriesRequest) {
+	w.Header().Set("Content-Type", contentTypeNDJSON)
+
+	var (
+		flusher, _ = w.(http.Flusher)
+		enc        = json.NewEncoder(w)
+	)
+
+	err := streamer.StreamRepositories(r.Context(), req, func(ev models.Event) error {
+		if ev.Type != models.EventRepository {
+			return nil
+		}
+
+		if err := enc.Encode(ev.Repository); err != nil {
+			return err
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		return nil
+	})
+	if err != nil {
+		logging.FromContext(r.Context()).WarnContext(r.Context(), "streaming repositories failed", "error", err)
+
+		enc.Encode(map[string]string{"error": err.Error()})
+	}
+}
+
+type progress struct {
+	Received int `json:"received"`
+	Count    int `json:"count"`
+}
+
+type retry struct {
+	Slot       int               `json:"slot"`
+	Reason     string            `json:"reason"`
+	Repository models.Repository `json:"repository"`
+}
+
+// serveEvents writes the collection as server-sent events. Every
+// repository event is followed by a progress event and the stream
+// is terminated by either a done or an error event.
+func serveEvents(w http.ResponseWriter, r *http.Request, streamer RepositoriesStreamer, req models.RepositoriesRequest) {
+	w.Header().Set("Content-Type", contentTypeEvents)
+	w.Header().Set("Cache-Control", "no-cache")
+
+	var (
+		flusher, _ = w.(http.Flusher)
+		received   int
+	)
+
+	send := func(event string, v interface{}) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+			return err
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		return nil
+	}
+
+	err := streamer.StreamRepositories(r.Context(), req, func(ev models.Event) error {
+		switch ev.Type {
+		case models.EventRepository:
+			received++
+
+			if err := send(string(models.EventRepository), ev.Repository); err != nil {
+				return err
+			}
+
+			return send("progress", progress{Received: received, Count: req.Count})
+		case models.EventRetry:
+			return send(string(models.EventRetry), retry{
+				Slot:       ev.Slot,
+				Reason:     ev.Reason,
+				Repository: ev.Repository,
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		logging.FromContext(r.Context()).WarnContext(r.Context(), "streaming repositories failed", "error", err)
+
+		send("error", map[string]string{"error": err.Error()})
+		return
+	}
+
+	send("done", progress{Received: received, Count: req.Count})
+}
@@ -0,0 +1,26 @@
+// Package stats summarises latencies measured by the command-line tools.
+package stats
+
+import (
+	"math"
+	"time"
+)
+
+// Percentile returns the p-th percentile of the sorted latencies
+// using the nearest-rank method, or 0 if there are none.
+func Percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := int(math.Ceil(p*float64(len(sorted))/100)) - 1
+	if rank < 0 {
+		rank = 0
+	}
+
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+
+	return sorted[rank]
+}
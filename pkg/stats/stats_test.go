@@ -0,0 +1,55 @@
+package stats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPercentile(t *testing.T) {
+	sorted := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+
+	for _, testCase := range []struct {
+		Name       string
+		Latencies  []time.Duration
+		Percentile float64
+		// expectations
+		ExpectedLatency time.Duration
+	}{
+		{
+			Name:            "no latencies",
+			Percentile:      50,
+			ExpectedLatency: 0,
+		},
+		{
+			Name:            "median",
+			Latencies:       sorted,
+			Percentile:      50,
+			ExpectedLatency: 5,
+		},
+		{
+			Name:            "p95",
+			Latencies:       sorted,
+			Percentile:      95,
+			ExpectedLatency: 10,
+		},
+		{
+			// rounding to the closest rank would give 9
+			Name:            "p94 rounds up to the next rank",
+			Latencies:       sorted,
+			Percentile:      94,
+			ExpectedLatency: 10,
+		},
+		{
+			Name:            "minimum",
+			Latencies:       sorted,
+			Percentile:      0,
+			ExpectedLatency: 1,
+		},
+	} {
+		t.Run(testCase.Name, func(t *testing.T) {
+			assert.Equal(t, testCase.ExpectedLatency, Percentile(testCase.Latencies, testCase.Percentile))
+		})
+	}
+}
@@ -0,0 +1,149 @@
+// Package tlsconfig loads TLS certificates for serving the proxy, reloading
+// them when their files change, and for calling the repository service.
+package tlsconfig
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// Client returns the configuration of a TLS client which trusts only the
+// CA certificates in caFile, or the system roots when caFile is empty,
+// and presents the certificate in certFile and keyFile if given.
+func Client(caFile, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s: no certificates found", caFile)
+		}
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// Reloader serves the certificate in a pair of files,
+// loading it again whenever either file changes.
+type Reloader struct {
+	certFile, keyFile string
+
+	mu     sync.RWMutex
+	cert   *tls.Certificate
+	digest [sha256.Size]byte
+}
+
+// NewReloader loads the certificate in certFile and keyFile.
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both a certificate and a key file are required")
+	}
+
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Server returns the configuration of a TLS server presenting the
+// current certificate of r.
+func (r *Reloader) Server() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+}
+
+// GetCertificate returns the current certificate, see tls.Config.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+// Watch checks the files every interval and reloads the certificate
+// when either has been modified. Failures to load are passed to errs,
+// if not nil, and the previous certificate is kept. It blocks until
+// ctx is done.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration, errs func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := r.reload(); err != nil && errs != nil {
+			errs(err)
+		}
+	}
+}
+
+// reload loads the certificate if the contents of either file have
+// changed since it was last loaded and reports whether it did so.
+// Contents are compared rather than modification times, which may be
+// too coarse to tell apart files rewritten in quick succession.
+func (r *Reloader) reload() (bool, error) {
+	certPEM, err := ioutil.ReadFile(r.certFile)
+	if err != nil {
+		return false, err
+	}
+
+	keyPEM, err := ioutil.ReadFile(r.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	hash := sha256.New()
+	hash.Write(certPEM)
+	hash.Write(keyPEM)
+
+	var digest [sha256.Size]byte
+	copy(digest[:], hash.Sum(nil))
+
+	r.mu.RLock()
+	unchanged := r.cert != nil && digest == r.digest
+	r.mu.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.Lock()
+	r.cert, r.digest = &cert, digest
+	r.mu.Unlock()
+
+	return true, nil
+}
@@ -0,0 +1,246 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/georgemac/repositories/pkg/codehost"
+	"github.com/georgemac/repositories/pkg/models"
+	"github.com/georgemac/repositories/pkg/repositories"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// keyPair is a certificate generated in memory for testing.
+type keyPair struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func (k keyPair) tls(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(k.certPEM, k.keyPEM)
+	require.Nil(t, err)
+
+	return cert
+}
+
+// write writes the certificate and key to dir, returning their paths.
+func (k keyPair) write(t *testing.T, dir, name string) (certFile, keyFile string) {
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	require.Nil(t, ioutil.WriteFile(certFile, k.certPEM, 0600))
+	require.Nil(t, ioutil.WriteFile(keyFile, k.keyPEM, 0600))
+
+	return
+}
+
+// generate returns a certificate for 127.0.0.1 named name, signed by
+// parent or self-signed as a CA when parent is nil.
+func generate(t *testing.T, name string, serial int64, parent *keyPair) keyPair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.Nil(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+
+	return keyPair{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "tlsconfig")
+	require.Nil(t, err)
+
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestReloader(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	var (
+		ca                = generate(t, "ca", 1, nil)
+		first             = generate(t, "first", 2, &ca)
+		second            = generate(t, "second", 3, &ca)
+		certFile, keyFile = first.write(t, dir, "server")
+	)
+
+	certs, err := NewReloader(certFile, keyFile)
+	require.Nil(t, err)
+
+	// httptest.Server adds its own certificate, which would take precedence
+	l, err := tls.Listen("tcp", "127.0.0.1:0", certs.Server())
+	require.Nil(t, err)
+
+	defer l.Close()
+
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	served := func() string {
+		cli := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+
+		resp, err := cli.Get("https://" + l.Addr().String())
+		require.Nil(t, err)
+		resp.Body.Close()
+
+		return resp.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	assert.Equal(t, "first", served())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go certs.Watch(ctx, 10*time.Millisecond, func(err error) {
+		t.Error(err)
+	})
+
+	fi, err := os.Stat(certFile)
+	require.Nil(t, err)
+
+	second.write(t, dir, "server")
+
+	// rewritten within the same tick of a coarse clock
+	require.Nil(t, os.Chtimes(certFile, fi.ModTime(), fi.ModTime()))
+	require.Nil(t, os.Chtimes(keyFile, fi.ModTime(), fi.ModTime()))
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if served() == "second" {
+			break
+		}
+	}
+
+	assert.Equal(t, "second", served())
+}
+
+func TestClient(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	var (
+		ca                            = generate(t, "ca", 1, nil)
+		server                        = generate(t, "server", 2, &ca)
+		client                        = generate(t, "client", 3, &ca)
+		caFile                        = filepath.Join(dir, "ca.crt")
+		clientCertFile, clientKeyFile = client.write(t, dir, "client")
+		clientCAs                     = x509.NewCertPool()
+	)
+
+	require.Nil(t, ioutil.WriteFile(caFile, ca.certPEM, 0600))
+	clientCAs.AddCert(ca.cert)
+
+	// the CA of a default httptest.NewTLSServer
+	defaultServer := httptest.NewTLSServer(codehost.New(codehost.WithBehaviour(codehost.Behaviour{})))
+	defer defaultServer.Close()
+
+	defaultCAFile := filepath.Join(dir, "default.crt")
+	require.Nil(t, ioutil.WriteFile(defaultCAFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: defaultServer.Certificate().Raw,
+	}), 0600))
+
+	mutualServer := httptest.NewUnstartedServer(codehost.New(codehost.WithBehaviour(codehost.Behaviour{})))
+	mutualServer.TLS = &tls.Config{
+		Certificates: []tls.Certificate{server.tls(t)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	mutualServer.StartTLS()
+	defer mutualServer.Close()
+
+	for _, testCase := range []struct {
+		Name              string
+		URL               string
+		CAFile            string
+		CertFile, KeyFile string
+		ExpectedError     bool
+	}{
+		{
+			Name:   "custom CA",
+			URL:    defaultServer.URL,
+			CAFile: defaultCAFile,
+		},
+		{
+			Name:          "untrusted server",
+			URL:           defaultServer.URL,
+			ExpectedError: true,
+		},
+		{
+			Name:     "mutual TLS",
+			URL:      mutualServer.URL,
+			CAFile:   caFile,
+			CertFile: clientCertFile,
+			KeyFile:  clientKeyFile,
+		},
+		{
+			Name:          "mutual TLS without client certificate",
+			URL:           mutualServer.URL,
+			CAFile:        caFile,
+			ExpectedError: true,
+		},
+	} {
+		t.Run(testCase.Name, func(t *testing.T) {
+			cfg, err := Client(testCase.CAFile, testCase.CertFile, testCase.KeyFile)
+			require.Nil(t, err)
+
+			service, err := repositories.New(testCase.URL, repositories.WithTLSConfig(cfg))
+			require.Nil(t, err)
+
+			repos, err := service.Repositories(context.TODO(), models.NewRepositoriesRequest())
+			if testCase.ExpectedError {
+				assert.NotNil(t, err)
+				return
+			}
+
+			require.Nil(t, err)
+			assert.Len(t, repos, 1)
+		})
+	}
+}